@@ -0,0 +1,131 @@
+// Copyright (c) 2020-present devguard GmbH
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/kraudcloud/cradle/spec"
+)
+
+var CGROUPS_ONCE sync.Once
+
+func cgroupPath(index uint8) string {
+	return fmt.Sprintf("/sys/fs/cgroup/containers/%d", index)
+}
+
+// the parent of all container cgroups, with the controllers they need
+func containersCgroup() {
+	CGROUPS_ONCE.Do(func() {
+		os.MkdirAll("/sys/fs/cgroup/containers", 0755)
+		for _, dir := range []string{"/sys/fs/cgroup", "/sys/fs/cgroup/containers"} {
+			for _, ctrl := range []string{"+cpu", "+memory", "+io", "+pids"} {
+				err := os.WriteFile(dir+"/cgroup.subtree_control", []byte(ctrl), 0644)
+				if err != nil {
+					log.Warnf("cgroup: enable %s in %s: %v", ctrl, dir, err)
+				}
+			}
+		}
+	})
+}
+
+// open the cgroup of a container, so run() can clone straight into it
+func containerCgroup(index uint8) (*os.File, error) {
+
+	containersCgroup()
+
+	err := os.MkdirAll(cgroupPath(index), 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	return os.Open(cgroupPath(index))
+}
+
+// usage of a containers cgroup, missing files are left out
+func cgroupStats(index uint8) map[string]uint64 {
+
+	stats := make(map[string]uint64)
+	dir := cgroupPath(index)
+
+	cpu := readProcKV(dir + "/cpu.stat")
+	if v, ok := cpu["usage_usec"]; ok {
+		stats["cpu_usage_usec"] = v
+	}
+	if v, ok := cpu["throttled_usec"]; ok {
+		stats["cpu_throttled_usec"] = v
+	}
+	if v, ok := readProcKV(dir + "/memory.events")["oom_kill"]; ok {
+		stats["memory_oom_kill"] = v
+	}
+
+	for name, file := range map[string]string{
+		"memory_current": "memory.current",
+		"memory_peak":    "memory.peak",
+		"pids_current":   "pids.current",
+	} {
+		b, err := os.ReadFile(dir + "/" + file)
+		if err != nil {
+			continue
+		}
+		v, err := strconv.ParseUint(strings.TrimSpace(string(b)), 10, 64)
+		if err == nil {
+			stats[name] = v
+		}
+	}
+
+	return stats
+}
+
+// limit all containers together to the pod size the vmm tells us.
+// zero leaves a resource alone
+func containersLimit(cpu int, mem int) error {
+
+	containersCgroup()
+
+	if cpu > 0 {
+		err := os.WriteFile("/sys/fs/cgroup/containers/cpu.max", []byte(fmt.Sprintf("%d 100000", cpu*100000)), 0644)
+		if err != nil {
+			return fmt.Errorf("cpu.max: %w", err)
+		}
+	}
+
+	if mem > 0 {
+		err := os.WriteFile("/sys/fs/cgroup/containers/memory.max", []byte(fmt.Sprintf("%d", int64(mem)*1024*1024)), 0644)
+		if err != nil {
+			return fmt.Errorf("memory.max: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// the vmm resized the pod. the vm keeps its boot size, so the containers must follow
+func handleVmmResources(w http.ResponseWriter, r *http.Request) {
+
+	var resources spec.Resources
+	err := json.NewDecoder(r.Body).Decode(&resources)
+	if err != nil {
+		w.WriteHeader(400)
+		writeError(w, err.Error())
+		return
+	}
+
+	log.Printf("cradle: containers limited to cpu %d mem %dM", resources.Cpu, resources.Mem)
+
+	err = containersLimit(resources.Cpu, resources.Mem)
+	if err != nil {
+		log.Errorf("resources: %v", err)
+		w.WriteHeader(500)
+		writeError(w, err.Error())
+		return
+	}
+
+	w.WriteHeader(200)
+}
@@ -7,6 +7,7 @@ import (
 	"fmt"
 	"github.com/kraudcloud/cradle/spec"
 	"os"
+	"strings"
 )
 
 var CONFIG spec.Launch
@@ -37,6 +38,8 @@ func config() {
 		return
 	}
 
+	KEY_BROKERS = CONFIG.KeyBrokers()
+
 	for i, _ := range CONFIG.Containers {
 		CONFIG.Containers[i].Process.Env = append([]spec.Env{
 			{
@@ -55,3 +58,15 @@ func config() {
 	}
 
 }
+
+// replace secret env values before they leave the guest in logs
+func redact(s string) string {
+	for _, container := range CONFIG.Containers {
+		for _, v := range container.Process.Env {
+			if v.Secret && len(v.Value) > 3 {
+				s = strings.ReplaceAll(s, v.Value, "<redacted>")
+			}
+		}
+	}
+	return s
+}
@@ -0,0 +1,123 @@
+// Copyright (c) 2020-present devguard GmbH
+
+package main
+
+import (
+	"fmt"
+	"github.com/kraudcloud/cradle/spec"
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
+)
+
+func configMountsDir(index int) string {
+	return fmt.Sprintf("/run/configmounts/%d", index)
+}
+
+// materialize config mounts into a read only tmpfs, so they never end up
+// in the overlay upper dir on the cache disk
+func (c *Container) configMounts() error {
+
+	if len(c.Spec.ConfigMounts) == 0 {
+		return nil
+	}
+
+	dir := configMountsDir(int(c.Index))
+	os.MkdirAll(dir, 0755)
+
+	// not noexec, config mounts with an exec mode are scripts people want to run
+	var flags uintptr = syscall.MS_NOSUID | syscall.MS_NODEV
+
+	err := syscall.Mount("tmpfs", dir, "tmpfs", flags, "mode=0755")
+	if err != nil {
+		return fmt.Errorf("mount config tmpfs: %w", err)
+	}
+
+	for j, m := range c.Spec.ConfigMounts {
+
+		src := fmt.Sprintf("/config/configmounts/%d/%d", c.Index, j)
+		dst := filepath.Join(dir, strconv.Itoa(j))
+
+		content, err := os.ReadFile(src)
+		if err != nil {
+			return fmt.Errorf("config mount %s: %w", m.GuestPath, err)
+		}
+
+		var mode uint64 = 0444
+		if m.Mode != "" {
+			mode, err = strconv.ParseUint(m.Mode, 8, 32)
+			if err != nil {
+				return fmt.Errorf("config mount %s: invalid mode %s", m.GuestPath, m.Mode)
+			}
+		}
+
+		err = os.WriteFile(dst, content, 0600)
+		if err != nil {
+			return fmt.Errorf("config mount %s: %w", m.GuestPath, err)
+		}
+
+		os.Chown(dst, m.Uid, m.Gid)
+		os.Chmod(dst, os.FileMode(mode))
+
+		// only keep the copy the container can see
+		os.Remove(src)
+	}
+
+	err = syscall.Mount("", dir, "", syscall.MS_REMOUNT|syscall.MS_RDONLY|flags, "")
+	if err != nil {
+		return fmt.Errorf("remount config tmpfs: %w", err)
+	}
+
+	return nil
+}
+
+// bind config mounts into the container root. called from run2 inside the container mount namespace
+func bindConfigMounts(index int, container_root string, mounts []spec.ConfigMount) {
+
+	for j, m := range mounts {
+
+		if m.GuestPath == "" || m.GuestPath == "/" {
+			continue
+		}
+
+		gp := filepath.Join(container_root, m.GuestPath)
+
+		err := inChroot(container_root, func() error {
+
+			os.MkdirAll(filepath.Dir(m.GuestPath), 0755)
+
+			// dont truncate files from the image, we're mounting over them anyway
+			f, err := os.OpenFile(m.GuestPath, os.O_RDONLY|os.O_CREATE, 0644)
+			if err != nil {
+				return err
+			}
+			f.Close()
+
+			gpr, err := filepath.EvalSymlinks(m.GuestPath)
+			if err == nil {
+				gp = filepath.Join(container_root, gpr)
+			}
+
+			return nil
+		})
+		if err != nil {
+			log.Warnf("config mount: failed to create guest path %s: %v", m.GuestPath, err)
+			continue
+		}
+
+		src := filepath.Join(configMountsDir(index), strconv.Itoa(j))
+
+		err = syscall.Mount(src, gp, "", syscall.MS_BIND, "")
+		if err != nil {
+			log.Errorf("config mount %s: %v", gp, err)
+			continue
+		}
+
+		// MS_RDONLY is ignored on the initial bind
+		err = syscall.Mount("", gp, "", syscall.MS_BIND|syscall.MS_REMOUNT|syscall.MS_RDONLY, "")
+		if err != nil {
+			log.Errorf("config mount %s: %v", gp, err)
+		}
+	}
+}
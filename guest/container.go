@@ -4,6 +4,7 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"github.com/creack/pty"
 	"golang.org/x/sys/unix"
@@ -40,6 +41,9 @@ func main_run2(args []string) {
 	runtime.LockOSThread()
 	defer runtime.UnlockOSThread()
 
+	// ipc and uts sysctls only affect the namespaces we're in now
+	containerSysctls(container)
+
 	// we're already in a mount namespace from clone
 	// make all changes private
 	syscall.Mount("", "/", "", syscall.MS_PRIVATE|syscall.MS_REC, "")
@@ -249,6 +253,8 @@ func main_run2(args []string) {
 		}
 	}
 
+	bindConfigMounts(index, newroot, container.ConfigMounts)
+
 	// bind mount /lib/modules so userspace can load more stuff
 	os.MkdirAll(newroot+"/lib/modules", 0755)
 	syscall.Mount(oldroot+"/lib/modules", newroot+"/lib/modules", "", syscall.MS_BIND|syscall.MS_RDONLY, "")
@@ -326,6 +332,9 @@ func main_run2(args []string) {
 		log.Warnf("runc: chdir failed: %s", err)
 	}
 
+	// before setuid, since raising hard limits needs root
+	rlimits(container.Process.Rlimits)
+
 	if container.Process.User != "" {
 		uid, err := strconv.Atoi(container.Process.User)
 		if err == nil {
@@ -336,6 +345,11 @@ func main_run2(args []string) {
 		}
 	}
 
+	if container.Process.Init {
+		initReaper(container.Process.Cmd[0], container.Process.Cmd, flatenv)
+		return
+	}
+
 	err = syscall.Exec(container.Process.Cmd[0], container.Process.Cmd, flatenv)
 	if err != nil {
 		log.Errorf("executing container command %s: %s", container.Process.Cmd[0], err)
@@ -377,12 +391,15 @@ func (c *Container) mount() error {
 		return fmt.Errorf("mount overlay %s: %w", overlay, err)
 	}
 
-	// if the volume is empty, copy the mount target into the volume
-	// docker has a nocopy flag as part of the VolumeOptions, but we don't have that
+	// if the volume is empty, copy the mount target into the volume, unless nocopy is set like docker VolumeOptions
 
 	for _, m := range c.Spec.VolumeMounts {
 
-		vp := filepath.Join("/var/lib/docker/volumes/", m.VolumeName, "_data", m.VolumePath)
+		if m.NoCopy {
+			continue
+		}
+
+		vp := volumePath(m)
 		gp := filepath.Join("/cache/containers/", fmt.Sprintf("%d", c.Index), "root", m.GuestPath)
 
 		files, _ := os.ReadDir(vp)
@@ -401,16 +418,14 @@ func (c *Container) mount() error {
 				return fmt.Errorf("unmount overlay: %w", err)
 			}
 
-			vp := filepath.Join("/var/lib/docker/volumes/", m.VolumeName, "_data", m.VolumePath)
+			vp := volumePath(m)
 			err = syscall.Mount(vp, root, "", syscall.MS_BIND, "")
 			if err != nil {
 				return fmt.Errorf("mount volume %s: %w", vp, err)
 			}
 
 		} else {
-			// docker mounts volumes as uid 1000, and some containers rely on that. scary
-			vp := filepath.Join("/var/lib/docker/volumes/", m.VolumeName, "_data", m.VolumePath)
-			os.Chown(vp, 1000, 1000)
+			prepareVolumePath(m)
 		}
 	}
 
@@ -474,20 +489,10 @@ func (c *Container) prepare() error {
 		f.Close()
 	}
 
-	/*
-		// create config mounts
-		// should those be bind mounts so its more obvious that they are not part of the image?
-		for _, mount := range c.Spec.ConfigMounts {
-			os.MkdirAll(fmt.Sprintf("%s/%s", root, filepath.Dir(mount.GuestPath)), 0755)
-			f, err = os.Create(fmt.Sprintf("%s/%s", root, mount.GuestPath))
-			if err != nil {
-				log.Error(fmt.Sprintf("create config mount file: %s", err))
-			} else {
-				f.Write(mount.Content)
-				f.Close()
-			}
-		}
-	*/
+	err = c.configMounts()
+	if err != nil {
+		return err
+	}
 
 	return nil
 }
@@ -518,6 +523,16 @@ func (c *Container) run() error {
 		//},},
 	}
 
+	// clone straight into the containers cgroup, so its usage can be reported per container
+	cgroup, err := containerCgroup(c.Index)
+	if err != nil {
+		log.Warnf("container %d cgroup: %v", c.Index, err)
+	} else {
+		defer cgroup.Close()
+		cmd.SysProcAttr.UseCgroupFD = true
+		cmd.SysProcAttr.CgroupFD = int(cgroup.Fd())
+	}
+
 	if c.Spec.Process.Tty {
 		ptmx, err := pty.Start(cmd)
 		if err != nil {
@@ -528,8 +543,10 @@ func (c *Container) run() error {
 		c.Lock.Lock()
 		c.Pty = ptmx
 		c.Process = cmd.Process
+		c.State = "running"
 		c.Stdin = ptmx
 		c.Lock.Unlock()
+		containerEvent(c, "running", 0, "")
 
 		go func() {
 			defer c.Log.Close()
@@ -567,7 +584,9 @@ func (c *Container) run() error {
 
 		c.Lock.Lock()
 		c.Process = cmd.Process
+		c.State = "running"
 		c.Lock.Unlock()
+		containerEvent(c, "running", 0, "")
 
 		go func() {
 			defer c.Log.Close()
@@ -576,9 +595,6 @@ func (c *Container) run() error {
 				n, err := stdout.Read(buf[:])
 				if n > 0 {
 					c.Log.WriteWithDockerStream(buf[:n], 1)
-
-					// also write to cradle
-					log.Out.Write(buf[:n])
 				}
 				if err != nil {
 					break
@@ -593,9 +609,6 @@ func (c *Container) run() error {
 				n, err := stderr.Read(buf[:])
 				if n > 0 {
 					c.Log.WriteWithDockerStream(buf[:n], 2)
-
-					// also write to cradle
-					log.Out.Write(buf[:n])
 				}
 				if err != nil {
 					break
@@ -606,6 +619,16 @@ func (c *Container) run() error {
 
 	os.WriteFile(fmt.Sprintf("/cache/containers/%d/pid", c.Index), []byte(strconv.Itoa(cmd.Process.Pid)), 0644)
 
+	if c.Spec.Healthcheck != nil {
+		c.Lock.Lock()
+		c.Health = "starting"
+		c.Lock.Unlock()
+
+		hctx, hcancel := context.WithCancel(context.Background())
+		defer hcancel()
+		go c.healthcheck(hctx, time.Now())
+	}
+
 	state, err := cmd.Process.Wait()
 	if err != nil {
 		c.Pty.Close()
@@ -614,6 +637,12 @@ func (c *Container) run() error {
 
 	c.Pty.Close()
 
+	c.Lock.Lock()
+	c.ExitCode = exitCode(state.Sys().(syscall.WaitStatus))
+	c.State = "exited"
+	c.Lock.Unlock()
+	containerEvent(c, "exited", c.ExitCode, state.String())
+
 	lastlog := bytes.Buffer{}
 	c.Log.WriteTo(&lastlog)
 
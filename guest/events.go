@@ -0,0 +1,134 @@
+// Copyright (c) 2020-present devguard GmbH
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/kraudcloud/cradle/spec"
+)
+
+// events for the vmm. there are only a handful per boot, so all of them are kept
+// and replayed to every subscriber, including the ones emitted before vdocker is up
+var EVENTS = struct {
+	sync.Mutex
+	cond      *sync.Cond
+	events    []spec.Event
+	stage     spec.Stage
+	delivered uint64
+}{}
+
+func init() {
+	EVENTS.cond = sync.NewCond(&EVENTS.Mutex)
+}
+
+func event(e spec.Event) {
+
+	EVENTS.Lock()
+	defer EVENTS.Unlock()
+
+	e.Seq = uint64(len(EVENTS.events)) + 1
+	e.Time = time.Now()
+	if e.Type == spec.EVENT_STAGE {
+		EVENTS.stage = e.Stage
+	}
+	e.Stage = EVENTS.stage
+
+	EVENTS.events = append(EVENTS.events, e)
+	EVENTS.cond.Broadcast()
+}
+
+func stage(s spec.Stage) {
+	log.Printf("cradle: stage %s", s)
+	event(spec.Event{Type: spec.EVENT_STAGE, Stage: s})
+}
+
+func containerEvent(c *Container, state string, exitCode int, reason string) {
+	event(spec.Event{
+		Type:      spec.EVENT_CONTAINER,
+		Container: c.Spec.Name,
+		State:     state,
+		ExitCode:  exitCode,
+		Reason:    reason,
+	})
+}
+
+// wait until a vmm has received everything emitted so far, so the shutdown reason
+// makes it out before the guest powers off
+func flushEvents(timeout time.Duration) bool {
+
+	deadline := time.Now().Add(timeout)
+	go func() {
+		time.Sleep(timeout)
+		EVENTS.Lock()
+		EVENTS.cond.Broadcast()
+		EVENTS.Unlock()
+	}()
+
+	EVENTS.Lock()
+	defer EVENTS.Unlock()
+
+	for EVENTS.delivered < uint64(len(EVENTS.events)) {
+		if time.Now().After(deadline) {
+			return false
+		}
+		EVENTS.cond.Wait()
+	}
+
+	return true
+}
+
+// stream events as ndjson, starting after ?since=<seq>
+func handleVmmEvents(w http.ResponseWriter, r *http.Request) {
+
+	since, _ := strconv.ParseUint(r.URL.Query().Get("since"), 10, 64)
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(200)
+
+	flusher, _ := w.(http.Flusher)
+	enc := json.NewEncoder(w)
+
+	// wake up the wait below when the vmm goes away
+	done := r.Context().Done()
+	go func() {
+		<-done
+		EVENTS.Lock()
+		EVENTS.cond.Broadcast()
+		EVENTS.Unlock()
+	}()
+
+	for {
+		EVENTS.Lock()
+		for uint64(len(EVENTS.events)) <= since && r.Context().Err() == nil {
+			EVENTS.cond.Wait()
+		}
+		pending := append([]spec.Event(nil), EVENTS.events[since:]...)
+		EVENTS.Unlock()
+
+		if r.Context().Err() != nil {
+			return
+		}
+
+		for _, e := range pending {
+			if err := enc.Encode(e); err != nil {
+				return
+			}
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+		since += uint64(len(pending))
+
+		EVENTS.Lock()
+		if since > EVENTS.delivered {
+			EVENTS.delivered = since
+		}
+		EVENTS.cond.Broadcast()
+		EVENTS.Unlock()
+	}
+}
@@ -15,33 +15,84 @@ import (
 	"strings"
 	"sync"
 	"syscall"
-	"time"
 )
 
 type Exec struct {
-	Cmd        []string
-	WorkingDir string
-	Env        []string
-	Tty        bool
-	host       bool
+	Cmd          []string
+	WorkingDir   string
+	Env          []string
+	Tty          bool
+	User         string
+	Privileged   bool
+	AttachStdin  bool
+	AttachStdout bool
+	AttachStderr bool
+	host         bool
 
 	running  bool
 	exitcode int
 
 	containerIndex uint8
-	execIndex      uint8
+	execIndex      uint32
 
 	ptmx *os.File
 	proc *os.Process
 }
 
-var EXECS = make(map[uint8]*Exec)
+var EXECS = make(map[uint32]*Exec)
+var EXECS_SERIAL uint32
 var EXECS_LOCK sync.Mutex
 
+// finished execs, oldest first
+var EXECS_FINISHED []uint32
+
+// containers live as long as the pod, so finished execs are kept for inspect
+// until this many newer ones have finished
+const execsFinishedMax = 256
+
+// register a new exec. must hold EXECS_LOCK
+func addExec(e *Exec) uint32 {
+
+	// older clients dont set any of the attach flags and expect everything.
+	// a detached start clears them again
+	if !e.AttachStdin && !e.AttachStdout && !e.AttachStderr {
+		e.AttachStdin = true
+		e.AttachStdout = true
+		e.AttachStderr = true
+	}
+
+	for {
+		EXECS_SERIAL++
+		if EXECS[EXECS_SERIAL] == nil {
+			e.execIndex = EXECS_SERIAL
+			EXECS[EXECS_SERIAL] = e
+			return EXECS_SERIAL
+		}
+	}
+}
+
+func (e *Exec) exited(exitcode int) {
+	EXECS_LOCK.Lock()
+	defer EXECS_LOCK.Unlock()
+
+	e.exitcode = exitcode
+	e.running = false
+
+	EXECS_FINISHED = append(EXECS_FINISHED, e.execIndex)
+	if len(EXECS_FINISHED) > execsFinishedMax {
+		delete(EXECS, EXECS_FINISHED[0])
+		EXECS_FINISHED = EXECS_FINISHED[1:]
+	}
+}
+
 func (e *Exec) Run(dout io.WriteCloser, din io.Reader) {
 
 	defer dout.Close()
 
+	if !e.AttachStdin {
+		din = strings.NewReader("")
+	}
+
 	var cmd *exec.Cmd
 
 	if e.host {
@@ -54,25 +105,15 @@ func (e *Exec) Run(dout io.WriteCloser, din io.Reader) {
 			CONTAINERS_LOCK.Unlock()
 
 			fmt.Fprintf(dout, "too early. container still creating.\r\n")
-			e.exitcode = 1
-			e.running = false
-			go func() {
-				time.Sleep(3 * time.Second)
-				EXECS_LOCK.Lock()
-				delete(EXECS, e.execIndex)
-				EXECS_LOCK.Unlock()
-			}()
+			e.exited(1)
 			return
 		}
 		container := CONTAINERS[e.containerIndex]
 		CONTAINERS_LOCK.Unlock()
 
-		if container == nil {
-			fmt.Fprintf(dout, "no such container\n")
-			return
-		}
-		if container.Process == nil {
+		if container == nil || container.Process == nil {
 			fmt.Fprintf(dout, "no such container\n")
+			e.exited(1)
 			return
 		}
 
@@ -80,36 +121,50 @@ func (e *Exec) Run(dout io.WriteCloser, din io.Reader) {
 			e.WorkingDir = container.Spec.Process.Workdir
 		}
 
+		// docker execs as the containers user unless told otherwise
+		user := e.User
+		if user == "" {
+			user = container.Spec.Process.User
+		}
+
 		cmd = exec.Command("/proc/self/exe", append([]string{
 			"nsenter",
 			fmt.Sprintf("%d", container.Index),
 			e.WorkingDir,
+			user,
 			e.Cmd[0],
 		}, e.Cmd[1:]...)...)
-
-		for _, v := range container.Spec.Process.Env {
-			cmd.Env = append(cmd.Env, fmt.Sprintf("%s=%s", v.Name, v.Value))
-		}
-
 	}
 
-	for _, v := range e.Env {
-		cmd.Env = append(cmd.Env, v)
+	if e.host {
+		if len(e.Env) > 0 {
+			cmd.Env = mergeEnv(append(os.Environ(), e.Env...))
+		}
+	} else {
+		// the container env is already in front, from handleContainerExec
+		cmd.Env = mergeEnv(e.Env)
 	}
 
 	if e.Tty {
 		ptmx, err := pty.Start(cmd)
 		if err != nil {
 			fmt.Fprintf(dout, "failed to start pty: %v\n", err)
+			e.exited(126)
 			return
 		}
 		defer ptmx.Close()
 
+		EXECS_LOCK.Lock()
 		e.ptmx = ptmx
 		e.proc = cmd.Process
+		EXECS_LOCK.Unlock()
 
 		go io.Copy(ptmx, din)
-		go io.Copy(dout, ptmx)
+		if e.AttachStdout {
+			go io.Copy(dout, ptmx)
+		} else {
+			go io.Copy(io.Discard, ptmx)
+		}
 
 	} else {
 
@@ -118,6 +173,7 @@ func (e *Exec) Run(dout io.WriteCloser, din io.Reader) {
 		stdout, err := cmd.StdoutPipe()
 		if err != nil {
 			fmt.Fprintf(dout, "failed to get stdout: %v\n", err)
+			e.exited(126)
 			return
 		}
 		defer stdout.Close()
@@ -125,6 +181,7 @@ func (e *Exec) Run(dout io.WriteCloser, din io.Reader) {
 		stderr, err := cmd.StderrPipe()
 		if err != nil {
 			fmt.Fprintf(dout, "failed to get stderr: %v\n", err)
+			e.exited(126)
 			return
 		}
 		defer stderr.Close()
@@ -132,60 +189,72 @@ func (e *Exec) Run(dout io.WriteCloser, din io.Reader) {
 		err = cmd.Start()
 		if err != nil {
 			fmt.Fprintf(dout, "failed to start: %v\n", err)
+			e.exited(126)
 			return
 		}
-		e.proc = cmd.Process
 
-		go func() {
-			var buf [1024]byte
-			for {
-				n, err := stdout.Read(buf[:])
-				if err != nil {
-					return
-				}
-
-				if dout, ok := dout.(*DockerMux); ok {
-					dout.WriteStream(1, buf[:n])
-				} else {
-					dout.Write(buf[:n])
-				}
-			}
-		}()
-
-		go func() {
-			var buf [1024]byte
-			for {
-				n, err := stderr.Read(buf[:])
-				if err != nil {
-					return
-				}
-				if dout, ok := dout.(*DockerMux); ok {
-					dout.WriteStream(2, buf[:n])
-				} else {
-					dout.Write(buf[:n])
-				}
-			}
-		}()
+		EXECS_LOCK.Lock()
+		e.proc = cmd.Process
+		EXECS_LOCK.Unlock()
 
+		go e.copyStream(dout, stdout, 1, e.AttachStdout)
+		go e.copyStream(dout, stderr, 2, e.AttachStderr)
 	}
 
-	e.exitcode = -1
-	ps, err := e.proc.Wait()
+	exitcode := -1
+	ps, err := cmd.Process.Wait()
 	if err == nil && ps != nil {
-		e.exitcode = ps.ExitCode()
+		exitcode = exitCode(ps.Sys().(syscall.WaitStatus))
 	}
 
-	e.running = false
-	go func() {
-		time.Sleep(3 * time.Second)
-		EXECS_LOCK.Lock()
-		delete(EXECS, e.execIndex)
-		EXECS_LOCK.Unlock()
-	}()
+	e.exited(exitcode)
 
 	return
 }
 
+func (e *Exec) copyStream(dout io.Writer, src io.Reader, stream uint8, attach bool) {
+
+	if !attach {
+		io.Copy(io.Discard, src)
+		return
+	}
+
+	var buf [1024]byte
+	for {
+		n, err := src.Read(buf[:])
+		if err != nil {
+			return
+		}
+
+		if dout, ok := dout.(*DockerMux); ok {
+			dout.WriteStream(stream, buf[:n])
+		} else {
+			dout.Write(buf[:n])
+		}
+	}
+}
+
+// dedup KEY=VALUE pairs, later ones win
+func mergeEnv(env []string) []string {
+
+	var keys []string
+	var values = make(map[string]string)
+
+	for _, kv := range env {
+		k := strings.SplitN(kv, "=", 2)[0]
+		if _, ok := values[k]; !ok {
+			keys = append(keys, k)
+		}
+		values[k] = kv
+	}
+
+	var r []string
+	for _, k := range keys {
+		r = append(r, values[k])
+	}
+	return r
+}
+
 func (c *Exec) Resize(w uint16, h uint16) error {
 	if c.ptmx == nil {
 		return nil
@@ -209,7 +278,8 @@ func main_nsenter(args []string) {
 
 	cid := args[1]
 	wd := args[2]
-	cmd := args[3:]
+	user := args[3]
+	cmd := args[4:]
 
 	pidstr, err := os.ReadFile(fmt.Sprintf("/cache/containers/%s/pid", cid))
 	if err != nil {
@@ -235,6 +305,15 @@ func main_nsenter(args []string) {
 		panic(err)
 	}
 
+	// we're in the containers root now, so this reads the containers passwd
+	if user != "" {
+		err = setUser(user)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "unable to find user %s: %v\n", user, err)
+			os.Exit(126)
+		}
+	}
+
 	unix.Chdir(wd)
 
 	var exe = cmd[0]
@@ -256,3 +335,83 @@ func main_nsenter(args []string) {
 		os.Exit(1)
 	}
 }
+
+// switch to a docker style user: name, uid, name:group or uid:gid
+func setUser(user string) error {
+
+	name, group, _ := strings.Cut(user, ":")
+
+	uid, gid, err := lookupPasswd(name)
+	if err != nil {
+		return err
+	}
+
+	if group != "" {
+		gid, err = lookupGroup(group)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = syscall.Setgroups([]int{gid})
+	if err != nil {
+		return err
+	}
+	err = syscall.Setgid(gid)
+	if err != nil {
+		return err
+	}
+	return syscall.Setuid(uid)
+}
+
+// uid and primary gid of a user name or numeric uid
+func lookupPasswd(name string) (int, int, error) {
+
+	uid, numeric := strconv.Atoi(name)
+
+	b, _ := os.ReadFile("/etc/passwd")
+	for _, line := range strings.Split(string(b), "\n") {
+		f := strings.Split(line, ":")
+		if len(f) < 4 {
+			continue
+		}
+		if f[0] == name || (numeric == nil && f[2] == name) {
+			uid, err := strconv.Atoi(f[2])
+			if err != nil {
+				continue
+			}
+			gid, err := strconv.Atoi(f[3])
+			if err != nil {
+				continue
+			}
+			return uid, gid, nil
+		}
+	}
+
+	// unknown numeric uids are fine, like in docker
+	if numeric == nil {
+		return uid, uid, nil
+	}
+
+	return 0, 0, fmt.Errorf("no matching entries in passwd file")
+}
+
+func lookupGroup(name string) (int, error) {
+
+	if gid, err := strconv.Atoi(name); err == nil {
+		return gid, nil
+	}
+
+	b, _ := os.ReadFile("/etc/group")
+	for _, line := range strings.Split(string(b), "\n") {
+		f := strings.Split(line, ":")
+		if len(f) < 3 {
+			continue
+		}
+		if f[0] == name {
+			return strconv.Atoi(f[2])
+		}
+	}
+
+	return 0, fmt.Errorf("no matching entries in group file")
+}
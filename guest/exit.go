@@ -4,8 +4,10 @@ package main
 
 import (
 	"bufio"
+	"bytes"
+	"errors"
 	"fmt"
-	//"github.com/kraudcloud/cradle/spec"
+	"github.com/kraudcloud/cradle/spec"
 	"os"
 	"strings"
 	"syscall"
@@ -28,9 +30,45 @@ func procmounts() []string {
 	return mounts
 }
 
+// a critical container exited, which takes the whole vm down
+type criticalExit struct {
+	name   string
+	code   int
+	output string
+}
+
+func (e *criticalExit) Error() string {
+	return fmt.Sprintf("critical container %s exited with code %d", e.name, e.code)
+}
+
+// last bytes the container wrote, starting at a line boundary if possible
+func (c *Container) lastOutput(max int) string {
+
+	buf := bytes.Buffer{}
+	c.Log.WriteTo(&buf)
+
+	out := buf.Bytes()
+	if len(out) > max {
+		out = out[len(out)-max:]
+		if i := bytes.IndexByte(out, '\n'); i >= 0 && i < len(out)-1 {
+			out = out[i+1:]
+		}
+	}
+
+	return string(out)
+}
+
 func exit(err error) {
 
-	//reportExit(err.Error())
+	shutdown := spec.Event{Type: spec.EVENT_SHUTDOWN, Reason: err.Error()}
+	var critical *criticalExit
+	if errors.As(err, &critical) {
+		shutdown.Container = critical.name
+		shutdown.ExitCode = critical.code
+		shutdown.Output = critical.output
+	}
+	event(shutdown)
+	stage(spec.STAGE_SHUTDOWN)
 
 	for _, container := range CONTAINERS {
 		container.stop(err.Error())
@@ -39,7 +77,9 @@ func exit(err error) {
 	log.Errorf("shutdown reason: %s\n", err.Error())
 	fmt.Printf("shutdown reason: %s\n", err.Error())
 
-	//vmm(spec.YC_KEY_SHUTDOWN, []byte(err.Error()))
+	if !flushEvents(2 * time.Second) {
+		log.Warn("vmm did not receive the shutdown reason")
+	}
 
 	// cmd := exec.Command("/bin/fsfreeze", "--freeze", "/cache/")
 	// cmd.Stdout = os.Stdout
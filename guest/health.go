@@ -0,0 +1,147 @@
+// Copyright (c) 2020-present devguard GmbH
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os/exec"
+	"time"
+
+	"github.com/kraudcloud/cradle/spec"
+)
+
+// run the containers healthcheck until ctx is done.
+// health is "starting" until the first check passes, then "healthy" or "unhealthy"
+func (c *Container) healthcheck(ctx context.Context, started time.Time) {
+
+	hc := c.Spec.Healthcheck
+
+	interval := time.Duration(hc.Interval) * time.Millisecond
+	if interval == 0 {
+		interval = 10 * time.Second
+	}
+	timeout := time.Duration(hc.Timeout) * time.Millisecond
+	if timeout == 0 {
+		timeout = 5 * time.Second
+	}
+	retries := hc.Retries
+	if retries == 0 {
+		retries = 3
+	}
+	startPeriod := time.Duration(hc.StartPeriod) * time.Millisecond
+
+	failures := 0
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+
+		err := c.runHealthcheck(ctx, timeout)
+
+		c.Lock.Lock()
+		health := c.Health
+		if err == nil {
+			failures = 0
+			c.Health = "healthy"
+		} else if time.Since(started) > startPeriod {
+			failures++
+			if failures >= retries {
+				c.Health = "unhealthy"
+			}
+		}
+		changed := health != c.Health
+		c.Lock.Unlock()
+
+		if changed {
+			if err != nil {
+				log.Warnf("container %s unhealthy: %v", c.Spec.Name, err)
+			}
+			containerEvent(c, "running", 0, "health "+c.Health)
+		}
+	}
+}
+
+func (c *Container) runHealthcheck(ctx context.Context, timeout time.Duration) error {
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, "/proc/self/exe", append([]string{
+		"nsenter",
+		fmt.Sprintf("%d", c.Index),
+		c.Spec.Process.Workdir,
+		c.Spec.Process.User,
+	}, c.Spec.Healthcheck.Cmd...)...)
+
+	for _, e := range c.Spec.Process.Env {
+		cmd.Env = append(cmd.Env, e.Name+"="+e.Value)
+	}
+
+	out, err := cmd.CombinedOutput()
+	if ctx.Err() != nil {
+		return fmt.Errorf("timed out after %s", timeout)
+	}
+	if err != nil {
+		if len(out) > 256 {
+			out = out[:256]
+		}
+		return fmt.Errorf("%v: %s", err, out)
+	}
+
+	return nil
+}
+
+// why the pod is not ready yet, or nil
+func podReady() error {
+
+	EVENTS.Lock()
+	stage := EVENTS.stage
+	EVENTS.Unlock()
+
+	if stage != spec.STAGE_POD_UP {
+		return fmt.Errorf("guest stage is %s", stage)
+	}
+
+	CONTAINERS_LOCK.Lock()
+	containers := append([]*Container(nil), CONTAINERS...)
+	CONTAINERS_LOCK.Unlock()
+
+	for _, c := range containers {
+		if c == nil || c.Spec.Lifecycle.Before != "" {
+			continue
+		}
+
+		c.Lock.Lock()
+		state, health := c.State, c.Health
+		c.Lock.Unlock()
+
+		if state != "running" {
+			return fmt.Errorf("container %s is %s", c.Spec.Name, state)
+		}
+		if health != "" && health != "healthy" {
+			return fmt.Errorf("container %s is %s", c.Spec.Name, health)
+		}
+	}
+
+	return nil
+}
+
+func handleVmmReady(w http.ResponseWriter, r *http.Request) {
+
+	w.Header().Set("Content-Type", "application/json")
+
+	err := podReady()
+	if err != nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		json.NewEncoder(w).Encode(map[string]interface{}{"Ready": false, "Reason": err.Error()})
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{"Ready": true})
+}
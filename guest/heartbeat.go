@@ -0,0 +1,55 @@
+// Copyright (c) 2020-present devguard GmbH
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// answered by init itself, so a beat means init is alive and not just the kernel
+func handleVmmHeartbeat(w http.ResponseWriter, r *http.Request) {
+
+	beat := map[string]interface{}{
+		"Memory": memoryStats(),
+	}
+
+	if b, err := os.ReadFile("/proc/uptime"); err == nil {
+		if fields := strings.Fields(string(b)); len(fields) > 0 {
+			beat["Uptime"], _ = strconv.ParseFloat(fields[0], 64)
+		}
+	}
+
+	if b, err := os.ReadFile("/proc/loadavg"); err == nil {
+		if fields := strings.Fields(string(b)); len(fields) >= 3 {
+			var load []float64
+			for _, f := range fields[:3] {
+				v, _ := strconv.ParseFloat(f, 64)
+				load = append(load, v)
+			}
+			beat["Load"] = load
+		}
+	}
+
+	// "some avg10=0.00 avg60=0.00 avg300=0.00 total=0", the share of time tasks stalled on memory
+	if b, err := os.ReadFile("/proc/pressure/memory"); err == nil {
+		pressure := make(map[string]float64)
+		for _, line := range strings.Split(strings.TrimSpace(string(b)), "\n") {
+			fields := strings.Fields(line)
+			if len(fields) < 2 {
+				continue
+			}
+			k, v, _ := strings.Cut(fields[1], "=")
+			if k == "avg10" {
+				pressure[fields[0]], _ = strconv.ParseFloat(v, 64)
+			}
+		}
+		beat["MemoryPressure"] = pressure
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(beat)
+}
@@ -3,6 +3,7 @@
 package main
 
 import (
+	"github.com/kraudcloud/cradle/spec"
 	golog "log"
 	"os"
 	"os/exec"
@@ -29,8 +30,13 @@ func main_init() {
 	log.Println("\033[1;34mKRAUDCLOUD CRADLE\033[0m")
 
 	wdinit()
+	volumeHotplug()
+	uevents()
 	makedev()
 	config()
+	logExport()
+	kernelModules()
+	sysctls()
 
 	var wg sync.WaitGroup
 	wg.Add(2)
@@ -41,6 +47,7 @@ func main_init() {
 	}()
 
 	go func() {
+		stage(spec.STAGE_NETWORK)
 		network()
 		podPrepare()
 		wg.Done()
@@ -50,10 +57,14 @@ func main_init() {
 
 	vdocker()
 
+	stage(spec.STAGE_LAYERS)
 	unpackLayers()
 
 	podUp("volumes")
 
+	stage(spec.STAGE_VOLUMES)
+	ephemeralVolumes()
+
 	wg.Add(2)
 	go func() {
 		blockVolumes()
@@ -71,6 +82,7 @@ func main_init() {
 	podUp("")
 
 	log.Println("cradle: up")
+	stage(spec.STAGE_POD_UP)
 
 	for {
 		time.Sleep(time.Minute)
@@ -97,6 +109,9 @@ func uinit() {
 	os.MkdirAll("/dev/mqueue", 0777)
 	syscall.Mount("none", "/dev/mqueue", "mqueue", syscall.MS_NOSUID|syscall.MS_NODEV|syscall.MS_NOEXEC|syscall.MS_RELATIME, "")
 
+	os.MkdirAll("/sys/fs/cgroup", 0777)
+	syscall.Mount("none", "/sys/fs/cgroup", "cgroup2", syscall.MS_NOSUID|syscall.MS_NODEV|syscall.MS_NOEXEC|syscall.MS_RELATIME, "")
+
 	os.MkdirAll("/run", 0777)
 	os.MkdirAll("/tmp", 0777)
 
@@ -117,25 +132,29 @@ func makedev() {
 	}
 
 	for _, f := range iter {
-		name := f.Name()
+		makedevBlock(f.Name())
+	}
+}
 
-		// /dev/disk/by-serial/serial
-		serial, err := os.ReadFile("/sys/class/block/" + name + "/serial")
-		if err == nil {
-			os.Symlink("/dev/"+name, "/dev/disk/by-serial/"+string(serial))
-		}
+// /dev/disk symlinks for a block device
+func makedevBlock(name string) {
 
-		serial, err = os.ReadFile("/sys/class/block/" + name + "/device/vpd_pg83")
-		if err == nil {
-			serial = serial[8:]
-
-			a, b, ok := strings.Cut(string(serial), ".")
-			if ok {
-				os.MkdirAll("/dev/disk/"+a, 0777)
-				os.Symlink("/dev/"+name, "/dev/disk/"+a+"/"+b)
-			} else {
-				os.Symlink("/dev/"+name, "/dev/disk/by-serial/"+string(serial))
-			}
+	// /dev/disk/by-serial/serial
+	serial, err := os.ReadFile("/sys/class/block/" + name + "/serial")
+	if err == nil {
+		os.Symlink("/dev/"+name, "/dev/disk/by-serial/"+string(serial))
+	}
+
+	serial, err = os.ReadFile("/sys/class/block/" + name + "/device/vpd_pg83")
+	if err == nil && len(serial) > 8 {
+		serial = serial[8:]
+
+		a, b, ok := strings.Cut(string(serial), ".")
+		if ok {
+			os.MkdirAll("/dev/disk/"+a, 0777)
+			os.Symlink("/dev/"+name, "/dev/disk/"+a+"/"+b)
+		} else {
+			os.Symlink("/dev/"+name, "/dev/disk/by-serial/"+string(serial))
 		}
 	}
 }
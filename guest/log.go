@@ -3,30 +3,82 @@
 package main
 
 import (
+	"bytes"
 	"io"
 	"net/http"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
+// one line (or partial line) of container output
+type LogEntry struct {
+	Time time.Time
+
+	// docker stream id: 1 stdout, 2 stderr. tty output is stdout
+	Stream uint8
+
+	Data []byte
+
+	// position in the output of all containers, for resuming a stream.
+	// entries read back from log files have none
+	Seq uint64
+}
+
+var LOG_SEQ atomic.Uint64
+
+// which entries to replay or follow, like the docker logs query
+type LogOptions struct {
+	Since      time.Time
+	Until      time.Time
+	Tail       int
+	Timestamps bool
+	Stdout     bool
+	Stderr     bool
+
+	// get output as it is written instead of line by line, for attach
+	raw bool
+}
+
+var LOG_ALL = &LogOptions{Tail: -1, Stdout: true, Stderr: true}
+
+// longer lines are split into several entries, like docker does
+const logLineMax = 16 * 1024
+
+// ring of log entries, bounded by the total size of their data
 type Log struct {
-	buffer    []byte
-	w         int
-	full      bool
+	entries   []LogEntry
+	size      int
+	maxSize   int
+	dropped   bool
 	lock      sync.RWMutex
-	consumers map[io.WriteCloser]bool
+	consumers map[io.WriteCloser]*LogOptions
+
+	// entries for consumers that are still replaying, written once the replay is done
+	held map[io.WriteCloser][]LogEntry
+
+	// optional persistent copy of everything written
+	file *LogFile
+
+	// callbacks for every entry, unlike consumers they survive Close
+	taps      map[int]func(LogEntry)
+	tapSerial int
+
+	// incomplete last line of each stream
+	partial map[uint8][]byte
 }
 
 func NewLog(size int) *Log {
 	self := &Log{}
-	self.buffer = make([]byte, size)
-	self.w = 0
-	self.full = false
-	self.consumers = make(map[io.WriteCloser]bool)
+	self.maxSize = size
+	self.consumers = make(map[io.WriteCloser]*LogOptions)
+	self.held = make(map[io.WriteCloser][]LogEntry)
+	self.partial = make(map[uint8][]byte)
 	return self
 }
 
 func (self *Log) Write(p []byte) (n int, err error) {
-	return self.WriteWithDockerStream(p, 0)
+	return self.WriteWithDockerStream(p, 1)
 }
 
 func (self *Log) WriteWithDockerStream(p []byte, stream uint8) (n int, err error) {
@@ -34,68 +86,260 @@ func (self *Log) WriteWithDockerStream(p []byte, stream uint8) (n int, err error
 	self.lock.Lock()
 	defer self.lock.Unlock()
 
-	for w, _ := range self.consumers {
-		if d, ok := w.(*DockerMux); ok {
-			_, err := d.WriteStream(stream, p)
-			if err != nil {
-				delete(self.consumers, w)
-			}
-		} else {
-			_, err := w.Write(p)
-			if err != nil {
-				delete(self.consumers, w)
-			}
-			if f, ok := w.(http.Flusher); ok {
-				f.Flush()
-			}
+	now := time.Now()
+
+	chunk := LogEntry{Time: now, Stream: stream, Data: p}
+	for w, opts := range self.consumers {
+		if !opts.raw || !opts.match(chunk) {
+			continue
+		}
+		err := chunk.writeTo(w, false)
+		if err != nil {
+			delete(self.consumers, w)
 		}
 	}
 
+	self.partial[stream] = append(self.partial[stream], p...)
+
 	for {
-		if self.w+len(p) < len(self.buffer) {
-			copy(self.buffer[self.w:], p)
-			self.w += len(p)
-			return len(p), nil
-		} else {
-			self.full = true
-			space := len(self.buffer) - self.w
-			copy(self.buffer[self.w:], p[:space])
-			self.w = 0
-			p = p[space:]
+		buf := self.partial[stream]
+
+		i := bytes.IndexByte(buf, '\n')
+		if i == -1 {
+			if len(buf) < logLineMax {
+				break
+			}
+			i = logLineMax - 1
 		}
+
+		self.add(LogEntry{
+			Time:   now,
+			Stream: stream,
+			Data:   append([]byte(nil), buf[:i+1]...),
+		})
+
+		self.partial[stream] = buf[i+1:]
+	}
+
+	if len(self.partial[stream]) == 0 {
+		delete(self.partial, stream)
+	}
+
+	return len(p), nil
+}
+
+// entries of incomplete lines, so nothing is lost when the output ends without a newline
+func (self *Log) flush() {
+	for stream, buf := range self.partial {
+		self.add(LogEntry{Time: time.Now(), Stream: stream, Data: buf})
 	}
+	self.partial = make(map[uint8][]byte)
+}
+
+func (self *Log) add(entry LogEntry) {
+
+	if len(entry.Data) > self.maxSize {
+		entry.Data = entry.Data[len(entry.Data)-self.maxSize:]
+	}
+
+	entry.Seq = LOG_SEQ.Add(1)
+
+	for w, opts := range self.consumers {
+		if opts.raw || !opts.match(entry) {
+			continue
+		}
+		if held, ok := self.held[w]; ok {
+			self.held[w] = append(held, entry)
+			continue
+		}
+		err := entry.writeTo(w, opts.Timestamps)
+		if err != nil {
+			delete(self.consumers, w)
+		}
+	}
+
+	self.entries = append(self.entries, entry)
+	self.size += len(entry.Data)
+
+	for self.size > self.maxSize {
+		self.size -= len(self.entries[0].Data)
+		self.entries = self.entries[1:]
+		self.dropped = true
+	}
+
+	for _, fn := range self.taps {
+		fn(entry)
+	}
+
+	if self.file != nil {
+		err := self.file.Write(entry)
+		if err != nil {
+			log.Errorf("log file: %v", err)
+			self.file = nil
+		}
+	}
+}
+
+// also write everything to rotated json files on the cache disk
+func (self *Log) SetFile(file *LogFile) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	self.file = file
 }
 
 func (self *Log) Clear() {
 	self.lock.Lock()
 	defer self.lock.Unlock()
 
-	self.w = 0
-	self.full = false
+	self.entries = nil
+	self.size = 0
 }
 
+// raw content of the whole ring
 func (self *Log) WriteTo(w io.Writer) (n int64, err error) {
 
 	self.lock.RLock()
 	defer self.lock.RUnlock()
 
-	n = int64(0)
-
-	if self.full {
-		n2, _ := w.Write(self.buffer[self.w:])
+	for _, e := range self.entries {
+		n2, err := w.Write(e.Data)
 		n += int64(n2)
+		if err != nil {
+			return n, err
+		}
+	}
+
+	return n, nil
+}
+
+// write matching entries to w. DockerMux writers get the original stream ids
+func (self *Log) Replay(w io.Writer, opts *LogOptions) error {
+
+	self.lock.RLock()
+	entries, files := self.history()
+	self.lock.RUnlock()
+
+	return replay(w, opts, entries, files)
+}
+
+// like Replay followed by Follow, without missing or repeating an entry in between
+func (self *Log) ReplayFollow(consumer io.WriteCloser, opts *LogOptions) error {
+
+	self.lock.Lock()
+	entries, files := self.history()
+	self.consumers[consumer] = opts
+	self.held[consumer] = nil
+	self.lock.Unlock()
+
+	err := replay(consumer, opts, entries, files)
+
+	for {
+		self.lock.Lock()
+		held := self.held[consumer]
+		if err != nil || len(held) == 0 {
+			delete(self.held, consumer)
+			if err != nil {
+				delete(self.consumers, consumer)
+			}
+			self.lock.Unlock()
+			return err
+		}
+		self.held[consumer] = nil
+		self.lock.Unlock()
+
+		for _, e := range held {
+			err = e.writeTo(consumer, opts.Timestamps)
+			if err != nil {
+				break
+			}
+		}
+	}
+}
+
+// the ring, and the files if the ring forgot something. must hold lock
+func (self *Log) history() ([]LogEntry, []logFileView) {
+	if !self.dropped || self.file == nil {
+		return self.entries, nil
+	}
+	return self.entries, self.file.open()
+}
+
+func replay(w io.Writer, opts *LogOptions, entries []LogEntry, files []logFileView) error {
+
+	var match []LogEntry
+
+	// the ring is the fast path. once it forgot something, the files know more.
+	// reading them must not block the container writing more
+	if files != nil {
+		match = logFileEntries(files, opts)
+	} else {
+		for _, e := range entries {
+			if opts.match(e) {
+				match = append(match, e)
+			}
+		}
+		if opts.Tail >= 0 && len(match) > opts.Tail {
+			match = match[len(match)-opts.Tail:]
+		}
 	}
-	n2, err := w.Write(self.buffer[:self.w])
-	n += int64(n2)
 
-	return n, err
+	for _, e := range match {
+		err := e.writeTo(w, opts.Timestamps)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
 }
 
 func (self *Log) Attach(consumer io.WriteCloser) {
+	self.Follow(consumer, &LogOptions{Tail: -1, Stdout: true, Stderr: true, raw: true})
+}
+
+// like Attach, but only new entries matching opts are written
+func (self *Log) Follow(consumer io.WriteCloser, opts *LogOptions) {
 	self.lock.Lock()
 	defer self.lock.Unlock()
 
-	self.consumers[consumer] = true
+	self.consumers[consumer] = opts
+}
+
+// call fn for every new entry. fn is called with the log locked and must not block
+func (self *Log) Tap(fn func(LogEntry)) int {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	if self.taps == nil {
+		self.taps = make(map[int]func(LogEntry))
+	}
+
+	self.tapSerial++
+	self.taps[self.tapSerial] = fn
+	return self.tapSerial
+}
+
+// like Tap, but also returns the entries in the ring.
+// no entry is missed or passed to both in between
+func (self *Log) TapEntries(fn func(LogEntry)) ([]LogEntry, int) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	if self.taps == nil {
+		self.taps = make(map[int]func(LogEntry))
+	}
+
+	self.tapSerial++
+	self.taps[self.tapSerial] = fn
+	return append([]LogEntry(nil), self.entries...), self.tapSerial
+}
+
+func (self *Log) Untap(id int) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	delete(self.taps, id)
 }
 
 func (self *Log) Detach(consumer io.WriteCloser) {
@@ -103,16 +347,57 @@ func (self *Log) Detach(consumer io.WriteCloser) {
 	defer self.lock.Unlock()
 
 	delete(self.consumers, consumer)
+	delete(self.held, consumer)
 }
 
 func (self *Log) Close() error {
 	self.lock.Lock()
 	defer self.lock.Unlock()
 
+	self.flush()
+
 	for w, _ := range self.consumers {
 		w.Close()
 	}
-	self.consumers = make(map[io.WriteCloser]bool)
+	self.consumers = make(map[io.WriteCloser]*LogOptions)
 
 	return nil
 }
+
+func (opts *LogOptions) match(e LogEntry) bool {
+
+	if e.Stream == 2 && !opts.Stderr {
+		return false
+	}
+	if e.Stream != 2 && !opts.Stdout {
+		return false
+	}
+	if !opts.Since.IsZero() && e.Time.Before(opts.Since) {
+		return false
+	}
+	if !opts.Until.IsZero() && e.Time.After(opts.Until) {
+		return false
+	}
+
+	return true
+}
+
+func (e LogEntry) writeTo(w io.Writer, timestamps bool) error {
+
+	data := e.Data
+	if timestamps {
+		data = append([]byte(e.Time.UTC().Format(time.RFC3339Nano)+" "), data...)
+	}
+
+	if d, ok := w.(*DockerMux); ok {
+		_, err := d.WriteStream(e.Stream, data)
+		return err
+	}
+
+	_, err := w.Write(data)
+	if f, ok := w.(http.Flusher); ok {
+		f.Flush()
+	}
+
+	return err
+}
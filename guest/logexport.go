@@ -0,0 +1,375 @@
+// Copyright (c) 2020-present devguard GmbH
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// a log line on its way to the remote collector
+type logRecord struct {
+	Time    time.Time
+	Level   logrus.Level
+	Message string
+
+	// "cradle" or the container name
+	App    string
+	Fields map[string]string
+}
+
+// nil unless CONFIG.LogExport is set
+var LOG_EXPORT chan logRecord
+
+// start shipping logs if configured. records are queued until the network is up
+func logExport() {
+
+	cfg := CONFIG.LogExport
+	if cfg == nil || cfg.Endpoint == "" {
+		return
+	}
+
+	var send func([]logRecord) error
+
+	switch cfg.Protocol {
+	case "syslog":
+		u, err := url.Parse(cfg.Endpoint)
+		if err != nil || (u.Scheme != "tcp" && u.Scheme != "udp") {
+			log.Errorf("log export: invalid syslog endpoint %s", cfg.Endpoint)
+			return
+		}
+		s := &syslogExporter{network: u.Scheme, addr: u.Host}
+		send = s.send
+
+	case "otlp":
+		o := &otlpExporter{url: strings.TrimSuffix(cfg.Endpoint, "/") + "/v1/logs", headers: cfg.Headers}
+		send = o.send
+
+	default:
+		log.Errorf("log export: unknown protocol %s", cfg.Protocol)
+		return
+	}
+
+	// dropping lines is better than blocking on a slow collector
+	LOG_EXPORT = make(chan logRecord, 8192)
+
+	log.AddHook(&exportHook{})
+
+	go func() {
+		var batch []logRecord
+		tick := time.NewTicker(time.Second)
+		for {
+			select {
+			case r := <-LOG_EXPORT:
+				batch = append(batch, r)
+				if len(batch) < 512 {
+					continue
+				}
+			case <-tick.C:
+				if len(batch) == 0 {
+					continue
+				}
+			}
+
+			// not logging the error, that would feed back into the export
+			err := send(batch)
+			if err != nil {
+				if len(batch) > 8192 {
+					batch = batch[len(batch)-8192:]
+				}
+				time.Sleep(time.Second)
+				continue
+			}
+			batch = nil
+		}
+	}()
+}
+
+func exportRecord(r logRecord) {
+	select {
+	case LOG_EXPORT <- r:
+	default:
+	}
+}
+
+// container output. called from a Log tap, so must not block
+func exportContainerLog(name string, e LogEntry) {
+
+	if LOG_EXPORT == nil {
+		return
+	}
+
+	stream := "stdout"
+	if e.Stream == 2 {
+		stream = "stderr"
+	}
+
+	exportRecord(logRecord{
+		Time:    e.Time,
+		Level:   logrus.InfoLevel,
+		Message: strings.TrimRight(redact(string(e.Data)), "\r\n"),
+		App:     name,
+		Fields: map[string]string{
+			"container": name,
+			"stream":    stream,
+		},
+	})
+}
+
+// cradle's own log
+type exportHook struct{}
+
+func (h *exportHook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+func (h *exportHook) Fire(entry *logrus.Entry) error {
+
+	fields := make(map[string]string)
+	for k, v := range entry.Data {
+		fields[k] = fmt.Sprint(v)
+	}
+
+	exportRecord(logRecord{
+		Time:    entry.Time,
+		Level:   entry.Level,
+		Message: strings.TrimRight(redact(entry.Message), "\r\n"),
+		App:     "cradle",
+		Fields:  fields,
+	})
+
+	return nil
+}
+
+// rfc5424 over udp, or tcp with octet counting framing (rfc6587)
+type syslogExporter struct {
+	network string
+	addr    string
+	conn    net.Conn
+}
+
+func (self *syslogExporter) send(batch []logRecord) error {
+
+	if self.conn == nil {
+		conn, err := net.DialTimeout(self.network, self.addr, 5*time.Second)
+		if err != nil {
+			return err
+		}
+		self.conn = conn
+	}
+
+	for _, r := range batch {
+
+		msg := syslogFormat(r)
+		if self.network == "tcp" {
+			msg = strconv.Itoa(len(msg)) + " " + msg
+		}
+
+		self.conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+		_, err := self.conn.Write([]byte(msg))
+		if err != nil {
+			self.conn.Close()
+			self.conn = nil
+			return err
+		}
+	}
+
+	return nil
+}
+
+func syslogFormat(r logRecord) string {
+
+	// facility daemon for cradle, user for containers
+	facility := 1
+	if r.App == "cradle" {
+		facility = 3
+	}
+
+	severity := 6
+	switch r.Level {
+	case logrus.PanicLevel:
+		severity = 0
+	case logrus.FatalLevel:
+		severity = 2
+	case logrus.ErrorLevel:
+		severity = 3
+	case logrus.WarnLevel:
+		severity = 4
+	case logrus.DebugLevel, logrus.TraceLevel:
+		severity = 7
+	}
+
+	msgid := "-"
+	if s, ok := r.Fields["stream"]; ok {
+		msgid = s
+	}
+
+	sd := "[cradle@32473 level=\"" + r.Level.String() + "\""
+	keys := make([]string, 0, len(r.Fields))
+	for k := range r.Fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		sd += " " + syslogParamName(k) + "=\"" + syslogParamValue(r.Fields[k]) + "\""
+	}
+	sd += "]"
+
+	return fmt.Sprintf("<%d>1 %s %s %s - %s %s %s",
+		facility*8+severity,
+		r.Time.UTC().Format(time.RFC3339Nano),
+		syslogHeaderField(CONFIG.ID),
+		syslogHeaderField(r.App),
+		msgid,
+		sd,
+		r.Message,
+	)
+}
+
+// header fields are printable ascii without spaces
+func syslogHeaderField(s string) string {
+	s = strings.Map(func(c rune) rune {
+		if c <= 32 || c >= 127 {
+			return '_'
+		}
+		return c
+	}, s)
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+func syslogParamName(s string) string {
+	return strings.Map(func(c rune) rune {
+		if c <= 32 || c >= 127 || c == '=' || c == ']' || c == '"' {
+			return '_'
+		}
+		return c
+	}, s)
+}
+
+func syslogParamValue(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, `]`, `\]`).Replace(s)
+}
+
+// otlp/http with json encoding, so we dont need the protobuf and grpc stack
+type otlpExporter struct {
+	url     string
+	headers map[string]string
+}
+
+type otlpAnyValue struct {
+	StringValue string `json:"stringValue"`
+}
+
+type otlpKeyValue struct {
+	Key   string       `json:"key"`
+	Value otlpAnyValue `json:"value"`
+}
+
+type otlpLogRecord struct {
+	TimeUnixNano   string         `json:"timeUnixNano"`
+	SeverityNumber int            `json:"severityNumber"`
+	SeverityText   string         `json:"severityText"`
+	Body           otlpAnyValue   `json:"body"`
+	Attributes     []otlpKeyValue `json:"attributes,omitempty"`
+}
+
+func (self *otlpExporter) send(batch []logRecord) error {
+
+	// one resourceLogs per app, so collectors can route by service.name
+	var apps []string
+	records := make(map[string][]otlpLogRecord)
+
+	for _, r := range batch {
+
+		if _, ok := records[r.App]; !ok {
+			apps = append(apps, r.App)
+		}
+
+		var attrs []otlpKeyValue
+		for k, v := range r.Fields {
+			attrs = append(attrs, otlpKeyValue{k, otlpAnyValue{v}})
+		}
+		sort.Slice(attrs, func(i, j int) bool { return attrs[i].Key < attrs[j].Key })
+
+		records[r.App] = append(records[r.App], otlpLogRecord{
+			TimeUnixNano:   strconv.FormatInt(r.Time.UnixNano(), 10),
+			SeverityNumber: otlpSeverity(r.Level),
+			SeverityText:   strings.ToUpper(r.Level.String()),
+			Body:           otlpAnyValue{r.Message},
+			Attributes:     attrs,
+		})
+	}
+
+	var resourceLogs []interface{}
+	for _, app := range apps {
+		resourceLogs = append(resourceLogs, map[string]interface{}{
+			"resource": map[string]interface{}{
+				"attributes": []otlpKeyValue{
+					{"service.name", otlpAnyValue{app}},
+					{"cradle.id", otlpAnyValue{CONFIG.ID}},
+				},
+			},
+			"scopeLogs": []interface{}{
+				map[string]interface{}{
+					"scope":      map[string]string{"name": "cradle"},
+					"logRecords": records[app],
+				},
+			},
+		})
+	}
+
+	js, err := json.Marshal(map[string]interface{}{"resourceLogs": resourceLogs})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", self.url, bytes.NewReader(js))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range self.headers {
+		req.Header.Set(k, v)
+	}
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("otlp: %s", resp.Status)
+	}
+
+	return nil
+}
+
+func otlpSeverity(level logrus.Level) int {
+	switch level {
+	case logrus.PanicLevel, logrus.FatalLevel:
+		return 21
+	case logrus.ErrorLevel:
+		return 17
+	case logrus.WarnLevel:
+		return 13
+	case logrus.DebugLevel:
+		return 5
+	case logrus.TraceLevel:
+		return 1
+	}
+	return 9
+}
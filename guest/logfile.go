@@ -0,0 +1,201 @@
+// Copyright (c) 2020-present devguard GmbH
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// docker json-file format, one entry per line
+type jsonLogLine struct {
+	Log    string    `json:"log"`
+	Stream string    `json:"stream"`
+	Time   time.Time `json:"time"`
+}
+
+// size rotated json log files in /cache/logs/<container>/.
+// they hold more history than the ring, but the cache disk is formatted on every boot,
+// so they don't survive a vm restart. that's what LogExport is for
+type LogFile struct {
+	path     string
+	maxSize  int64
+	maxFiles int
+
+	f    *os.File
+	size int64
+}
+
+func NewLogFile(name string, maxSize int64, maxFiles int) *LogFile {
+
+	if maxSize <= 0 {
+		maxSize = 10 * 1024 * 1024
+	}
+	if maxFiles <= 0 {
+		maxFiles = 5
+	}
+
+	return &LogFile{
+		path:     filepath.Join("/cache/logs", filepath.Base(name), "json.log"),
+		maxSize:  maxSize,
+		maxFiles: maxFiles,
+	}
+}
+
+// not safe for concurrent use, Log holds its lock
+func (self *LogFile) Write(e LogEntry) error {
+
+	if self.f == nil {
+		os.MkdirAll(filepath.Dir(self.path), 0755)
+		f, err := os.OpenFile(self.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0640)
+		if err != nil {
+			return err
+		}
+		self.f = f
+
+		if st, err := f.Stat(); err == nil {
+			self.size = st.Size()
+		}
+	}
+
+	stream := "stdout"
+	if e.Stream == 2 {
+		stream = "stderr"
+	}
+
+	js, err := json.Marshal(jsonLogLine{Log: string(e.Data), Stream: stream, Time: e.Time})
+	if err != nil {
+		return err
+	}
+	js = append(js, '\n')
+
+	n, err := self.f.Write(js)
+	self.size += int64(n)
+	if err != nil {
+		return err
+	}
+
+	if self.size >= self.maxSize {
+		return self.rotate()
+	}
+
+	return nil
+}
+
+// json.log -> json.log.1 -> ... -> json.log.<maxFiles-1>
+func (self *LogFile) rotate() error {
+
+	self.f.Close()
+	self.f = nil
+	self.size = 0
+
+	if self.maxFiles < 2 {
+		return os.Remove(self.path)
+	}
+
+	for i := self.maxFiles - 1; i > 1; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", self.path, i-1), fmt.Sprintf("%s.%d", self.path, i))
+	}
+
+	return os.Rename(self.path, self.path+".1")
+}
+
+// a log file as far as it was written when opened
+type logFileView struct {
+	f    *os.File
+	size int64
+}
+
+// open the files newest first. the caller holds the Log lock, so nothing rotates in between
+// and the views can be read later without it
+func (self *LogFile) open() []logFileView {
+
+	views := make([]logFileView, 0, self.maxFiles)
+
+	for i := 0; i < self.maxFiles; i++ {
+
+		path := self.path
+		if i > 0 {
+			path = fmt.Sprintf("%s.%d", self.path, i)
+		}
+
+		f, err := os.Open(path)
+		if err != nil {
+			continue
+		}
+
+		st, err := f.Stat()
+		if err != nil {
+			f.Close()
+			continue
+		}
+
+		views = append(views, logFileView{f: f, size: st.Size()})
+	}
+
+	return views
+}
+
+// the last tail entries in the files matching opts, oldest first. all of them if tail is negative.
+// files are read newest first, so a short tail only reads the current one. closes the files
+func logFileEntries(views []logFileView, opts *LogOptions) []LogEntry {
+
+	defer func() {
+		for _, v := range views {
+			v.f.Close()
+		}
+	}()
+
+	var reversed []LogEntry
+
+	for _, v := range views {
+
+		if opts.Tail >= 0 && len(reversed) >= opts.Tail {
+			break
+		}
+
+		b, err := io.ReadAll(io.NewSectionReader(v.f, 0, v.size))
+		if err != nil {
+			continue
+		}
+
+		lines := bytes.Split(b, []byte{'\n'})
+		for j := len(lines) - 1; j >= 0; j-- {
+
+			if opts.Tail >= 0 && len(reversed) >= opts.Tail {
+				break
+			}
+
+			var line jsonLogLine
+			if json.Unmarshal(lines[j], &line) != nil {
+				continue
+			}
+
+			var stream uint8 = 1
+			if line.Stream == "stderr" {
+				stream = 2
+			}
+
+			e := LogEntry{
+				Time:   line.Time,
+				Stream: stream,
+				Data:   []byte(line.Log),
+			}
+			if opts.match(e) {
+				reversed = append(reversed, e)
+			}
+		}
+	}
+
+	entries := make([]LogEntry, len(reversed))
+	for i, e := range reversed {
+		entries[len(reversed)-1-i] = e
+	}
+
+	return entries
+}
@@ -0,0 +1,230 @@
+// Copyright (c) 2020-present devguard GmbH
+
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"github.com/kraudcloud/cradle/spec"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"time"
+)
+
+// key brokers of the launch config. they are part of the sev-snp host-data,
+// so volumes attached later can only use one of these
+var KEY_BROKERS []string
+
+// request to the key broker. the report binds sha256 of this struct without the report,
+// which includes the public half of a key only this guest has
+type keyBrokerRequest struct {
+	LaunchID  string `json:"launchID"`
+	Volume    string `json:"volume"`
+	KeyID     string `json:"keyID"`
+	PublicKey []byte `json:"publicKey"`
+	Report    []byte `json:"report,omitempty"`
+}
+
+// the broker encrypts the passphrase to the guests x25519 key with an ephemeral one of its own.
+// the aes-256-gcm key is sha256(shared secret || guest public key || broker public key)
+type keyBrokerResponse struct {
+	PublicKey  []byte `json:"publicKey"`
+	Nonce      []byte `json:"nonce"`
+	Ciphertext []byte `json:"ciphertext"`
+}
+
+// fetch the volume passphrase from the key broker in exchange for an attestation report.
+// the host may relay the report, but it can't unwrap the key it gets back
+func volumeKey(ref spec.Volume) ([]byte, error) {
+
+	broker, err := url.Parse(ref.Encryption.KeyBroker)
+	if err != nil {
+		return nil, fmt.Errorf("key broker: %w", err)
+	}
+	if broker.Scheme != "https" {
+		return nil, fmt.Errorf("key broker %s: must be https", ref.Encryption.KeyBroker)
+	}
+
+	known := false
+	for _, b := range KEY_BROKERS {
+		if b == ref.Encryption.KeyBroker {
+			known = true
+		}
+	}
+	if !known {
+		return nil, fmt.Errorf("key broker %s: not part of the launch config", ref.Encryption.KeyBroker)
+	}
+
+	priv, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	req := keyBrokerRequest{
+		LaunchID:  CONFIG.ID,
+		Volume:    ref.Name,
+		KeyID:     ref.Encryption.KeyID,
+		PublicKey: priv.PublicKey().Bytes(),
+	}
+	if req.KeyID == "" {
+		req.KeyID = ref.Name
+	}
+
+	js, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+
+	var reportData [64]byte
+	h := sha256.Sum256(js)
+	copy(reportData[:], h[:])
+
+	req.Report, err = attestationReport(reportData)
+	if err != nil {
+		return nil, err
+	}
+
+	// the broker checks host-data too, this just fails early on a host that lied to us
+	hostData, err := reportHostData(req.Report)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(hostData, spec.HostData(CONFIG.ID, KEY_BROKERS)) {
+		return nil, fmt.Errorf("key broker: launched with different host-data")
+	}
+
+	js, err = json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Post(ref.Encryption.KeyBroker, "application/json", bytes.NewReader(js))
+	if err != nil {
+		return nil, fmt.Errorf("key broker: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("key broker: %s", resp.Status)
+	}
+
+	var wrapped keyBrokerResponse
+	err = json.NewDecoder(io.LimitReader(resp.Body, 16384)).Decode(&wrapped)
+	if err != nil {
+		return nil, fmt.Errorf("key broker: %w", err)
+	}
+
+	key, err := unwrapVolumeKey(priv, wrapped)
+	if err != nil {
+		return nil, fmt.Errorf("key broker: %w", err)
+	}
+	if len(key) == 0 {
+		return nil, fmt.Errorf("key broker: empty key")
+	}
+
+	return key, nil
+}
+
+func unwrapVolumeKey(priv *ecdh.PrivateKey, wrapped keyBrokerResponse) ([]byte, error) {
+
+	pub, err := ecdh.X25519().NewPublicKey(wrapped.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+
+	shared, err := priv.ECDH(pub)
+	if err != nil {
+		return nil, err
+	}
+
+	h := sha256.New()
+	h.Write(shared)
+	h.Write(priv.PublicKey().Bytes())
+	h.Write(wrapped.PublicKey)
+
+	block, err := aes.NewCipher(h.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(wrapped.Nonce) != gcm.NonceSize() {
+		return nil, fmt.Errorf("invalid nonce")
+	}
+
+	return gcm.Open(nil, wrapped.Nonce, wrapped.Ciphertext, nil)
+}
+
+func luksMapperName(name string) string {
+	return name + "-crypt"
+}
+
+// open an encrypted volume, formatting it if it is empty.
+// returns the path of the plaintext device
+func luksOpen(ref spec.Volume, device string, blkid string) (string, error) {
+
+	if blkid != "" && blkid != "crypto_LUKS" {
+		return "", fmt.Errorf("volume %s is supposed to be encrypted but contains %s", ref.Name, blkid)
+	}
+
+	key, err := volumeKey(ref)
+	if err != nil {
+		return "", err
+	}
+
+	if blkid == "" {
+		log.Printf("cradle: luks formatting volume %s", ref.Name)
+		err = cryptsetup(key, "luksFormat", "--batch-mode", "--type", "luks2", "--key-file", "-", device)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	err = cryptsetup(key, "open", "--key-file", "-", device, luksMapperName(ref.Name))
+	if err != nil {
+		return "", err
+	}
+
+	return "/dev/mapper/" + luksMapperName(ref.Name), nil
+}
+
+func luksClose(name string) {
+
+	if _, err := os.Stat("/dev/mapper/" + luksMapperName(name)); err != nil {
+		return
+	}
+
+	err := cryptsetup(nil, "close", luksMapperName(name))
+	if err != nil {
+		log.Errorf("volume: %v", err)
+	}
+}
+
+func cryptsetup(key []byte, args ...string) error {
+
+	cmd := exec.Command("/sbin/cryptsetup", args...)
+	cmd.Stdin = bytes.NewReader(key)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	err := cmd.Run()
+	if err != nil {
+		return fmt.Errorf("cryptsetup %s: %w", args[0], err)
+	}
+
+	return nil
+}
@@ -0,0 +1,59 @@
+// Copyright (c) 2020-present devguard GmbH
+
+package main
+
+import (
+	"bufio"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// parse a /proc key value file like meminfo or vmstat
+func readProcKV(path string) map[string]uint64 {
+
+	kv := make(map[string]uint64)
+
+	f, err := os.Open(path)
+	if err != nil {
+		return kv
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(strings.Replace(scanner.Text(), ":", " ", 1))
+		if len(fields) < 2 {
+			continue
+		}
+		v, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil {
+			continue
+		}
+		kv[fields[0]] = v
+	}
+
+	return kv
+}
+
+// guest memory as seen from the inside, including what the balloon took away
+func memoryStats() map[string]interface{} {
+
+	meminfo := readProcKV("/proc/meminfo")
+	vmstat := readProcKV("/proc/vmstat")
+
+	// balloon pages are 4k
+	inflated := vmstat["balloon_inflate"] - vmstat["balloon_deflate"]
+
+	return map[string]interface{}{
+		"Total":           meminfo["MemTotal"] * 1024,
+		"Free":            meminfo["MemFree"] * 1024,
+		"Available":       meminfo["MemAvailable"] * 1024,
+		"Cached":          meminfo["Cached"] * 1024,
+		"SwapTotal":       meminfo["SwapTotal"] * 1024,
+		"SwapFree":        meminfo["SwapFree"] * 1024,
+		"BalloonInflated": inflated * 4096,
+		"BalloonInflates": vmstat["balloon_inflate"],
+		"BalloonDeflates": vmstat["balloon_deflate"],
+	}
+}
@@ -0,0 +1,31 @@
+// Copyright (c) 2020-present devguard GmbH
+
+package main
+
+import (
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// load extra kernel modules from cradle.json and the launch intent
+func kernelModules() {
+
+	for _, module := range CONFIG.Kernel.Modules {
+
+		args := strings.Fields(module)
+		if len(args) == 0 {
+			continue
+		}
+
+		log.Printf("cradle: modprobe %s", module)
+
+		cmd := exec.Command("/sbin/modprobe", args...)
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		err := cmd.Run()
+		if err != nil {
+			log.Errorf("modprobe %s: %v", args[0], err)
+		}
+	}
+}
@@ -0,0 +1,16 @@
+//go:build !snp
+// +build !snp
+
+package main
+
+import (
+	"fmt"
+)
+
+func attestationReport(reportData [64]byte) ([]byte, error) {
+	return nil, fmt.Errorf("sev: attestation requires a cradle built with -tags snp")
+}
+
+func reportHostData(report []byte) ([]byte, error) {
+	return nil, fmt.Errorf("sev: attestation requires a cradle built with -tags snp")
+}
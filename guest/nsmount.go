@@ -0,0 +1,98 @@
+// Copyright (c) 2020-present devguard GmbH
+
+package main
+
+import (
+	"fmt"
+	"golang.org/x/sys/unix"
+	"os"
+	"runtime"
+	"syscall"
+)
+
+// run f inside the mount namespace of a running container.
+// the thread goes back to our namespace afterwards, if that fails it dies with the goroutine
+func inContainerMountNs(c *Container, f func() error) error {
+
+	c.Lock.Lock()
+	proc := c.Process
+	c.Lock.Unlock()
+
+	if proc == nil {
+		return fmt.Errorf("container %s is not running", c.Spec.Name)
+	}
+
+	pidfd, err := unix.PidfdOpen(proc.Pid, 0)
+	if err != nil {
+		return fmt.Errorf("PidfdOpen: %w", err)
+	}
+	defer unix.Close(pidfd)
+
+	ours, err := os.Open("/proc/self/ns/mnt")
+	if err != nil {
+		return err
+	}
+	defer ours.Close()
+
+	errc := make(chan error)
+	go func() {
+		runtime.LockOSThread()
+
+		err := unix.Unshare(unix.CLONE_FS)
+		if err != nil {
+			runtime.UnlockOSThread()
+			errc <- fmt.Errorf("unshare: %w", err)
+			return
+		}
+
+		err = unix.Setns(pidfd, unix.CLONE_NEWNS)
+		if err == nil {
+			err = f()
+		} else {
+			err = fmt.Errorf("setns: %w", err)
+		}
+
+		if unix.Setns(int(ours.Fd()), unix.CLONE_NEWNS) == nil {
+			runtime.UnlockOSThread()
+		}
+
+		errc <- err
+	}()
+
+	return <-errc
+}
+
+// bind mount a path of the cradle into a running container
+func bindIntoContainer(c *Container, src string, dst string, readonly bool) error {
+
+	tree, err := unix.OpenTree(unix.AT_FDCWD, src, unix.OPEN_TREE_CLONE|unix.OPEN_TREE_CLOEXEC|unix.AT_RECURSIVE)
+	if err != nil {
+		return fmt.Errorf("open_tree %s: %w", src, err)
+	}
+	defer unix.Close(tree)
+
+	return inContainerMountNs(c, func() error {
+
+		os.MkdirAll(dst, 0755)
+
+		err := unix.MoveMount(tree, "", unix.AT_FDCWD, dst, unix.MOVE_MOUNT_F_EMPTY_PATH)
+		if err != nil {
+			return fmt.Errorf("move_mount %s: %w", dst, err)
+		}
+
+		if readonly {
+			err = syscall.Mount("", dst, "", syscall.MS_BIND|syscall.MS_REMOUNT|syscall.MS_RDONLY, "")
+			if err != nil {
+				return fmt.Errorf("remount ro %s: %w", dst, err)
+			}
+		}
+
+		return nil
+	})
+}
+
+func unmountInContainer(c *Container, dst string) error {
+	return inContainerMountNs(c, func() error {
+		return syscall.Unmount(dst, syscall.MNT_DETACH)
+	})
+}
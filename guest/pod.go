@@ -21,9 +21,13 @@ type Container struct {
 	Log   *Log
 	Stdin io.WriteCloser
 
-	Lock    sync.Mutex
-	Pty     *os.File
-	Process *os.Process
+	Lock     sync.Mutex
+	Pty      *os.File
+	Process  *os.Process
+	ExitCode int
+	State    string
+	Health   string
+	Restarts int
 
 	cancel context.CancelFunc
 }
@@ -45,11 +49,30 @@ func podPrepare() {
 
 		//ctx, cancel := context.WithCancel(context.Background())
 
-		log := NewLog(1024 * 1024)
+		ringSize := c.Logging.RingSize
+		if ringSize <= 0 {
+			ringSize = 1024 * 1024
+		}
+
+		name := c.Name
+		if name == "" {
+			name = fmt.Sprintf("container.%d", i)
+		}
+
+		log := NewLog(ringSize)
+		if c.Logging.Driver == "" || c.Logging.Driver == "json-file" {
+			log.SetFile(NewLogFile(name, c.Logging.MaxSize, c.Logging.MaxFiles))
+		}
+		if LOG_EXPORT != nil {
+			log.Tap(func(e LogEntry) {
+				exportContainerLog(name, e)
+			})
+		}
 		container := &Container{
 			Index:  uint8(i),
 			Log:    log,
 			Spec:   c,
+			State:  "created",
 			//cancel: cancel,
 		}
 
@@ -131,7 +154,7 @@ func (c *Container) stop(reason string) {
 
 	lastlog := bytes.Buffer{}
 	c.Log.WriteTo(&lastlog)
-	//reportContainerState(c.Spec.ID, spec.STATE_EXITED, -1, reason, lastlog.Bytes())
+	containerEvent(c, "stopped", c.ExitCode, reason)
 }
 
 func (c *Container) manager(ctx context.Context) {
@@ -151,6 +174,12 @@ func (c *Container) manager(ctx context.Context) {
 	}
 	for attempt := 1; ; attempt++ {
 
+		if attempt > 1 {
+			c.Lock.Lock()
+			c.Restarts++
+			c.Lock.Unlock()
+		}
+
 		c.Log.Write([]byte("[        o ~.~ o       ]: entering container " + c.Spec.Name + "\r\n\r\n"))
 
 		err = c.run()
@@ -161,12 +190,16 @@ func (c *Container) manager(ctx context.Context) {
 		default:
 		}
 
+		c.Lock.Lock()
+		exitCode := c.ExitCode
+		c.Lock.Unlock()
+
 		var restart = true
 		if err == nil {
 			log.Println("container", c.Spec.Name, "exited")
 			restart = c.Spec.Lifecycle.RestartOnSuccess
 		} else {
-			log.Println("container", c.Spec.Name, "exited with error:", err)
+			log.Println("container", c.Spec.Name, "exited with code", exitCode, ":", err)
 			restart = c.Spec.Lifecycle.RestartOnFailure
 		}
 
@@ -197,6 +230,11 @@ func (c *Container) manager(ctx context.Context) {
 
 	if c.Spec.Lifecycle.Critical {
 		time.Sleep(time.Millisecond * 100)
-		exit(fmt.Errorf("critical container %s exited", c.Spec.Name))
+
+		c.Lock.Lock()
+		code := c.ExitCode
+		c.Lock.Unlock()
+
+		exit(&criticalExit{name: c.Spec.Name, code: code, output: c.lastOutput(2048)})
 	}
 }
@@ -0,0 +1,77 @@
+// Copyright (c) 2020-present devguard GmbH
+
+package main
+
+import (
+	"golang.org/x/sys/unix"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// stay pid 1 of the container instead of exec'ing the command.
+// forwards signals to the command, reaps orphans and exits with the commands exit code
+func initReaper(argv0 string, argv []string, env []string) {
+
+	sigs := make(chan os.Signal, 64)
+	signal.Notify(sigs)
+
+	attr := &syscall.ProcAttr{
+		Env:   env,
+		Files: []uintptr{0, 1, 2},
+		Sys:   &syscall.SysProcAttr{Setpgid: true},
+	}
+
+	// like tini, the command becomes the foreground process group of the tty.
+	// ctrl-c then reaches it once from the kernel and not a second time from us
+	if _, err := unix.IoctlGetTermios(0, unix.TCGETS); err == nil {
+		attr.Sys.Foreground = true
+		attr.Sys.Ctty = 0
+	}
+
+	pid, err := syscall.ForkExec(argv0, argv, attr)
+	if err != nil && attr.Sys.Foreground {
+		// a tty that isn't our controlling terminal
+		attr.Sys.Foreground = false
+		pid, err = syscall.ForkExec(argv0, argv, attr)
+	}
+	if err != nil {
+		log.Errorf("executing container command %s: %s", argv0, err)
+		os.Exit(127)
+	}
+
+	for sig := range sigs {
+		switch sig {
+		case syscall.SIGCHLD:
+			for {
+				var ws syscall.WaitStatus
+				wpid, err := syscall.Wait4(-1, &ws, syscall.WNOHANG, nil)
+				if err != nil || wpid <= 0 {
+					break
+				}
+
+				// exiting as pid 1 kills everything else in the namespace
+				if wpid == pid {
+					os.Exit(exitCode(ws))
+				}
+			}
+
+		// used by the go runtime for preemption
+		case syscall.SIGURG:
+
+		// we are a background process group now, touching the tty must not stop us
+		case syscall.SIGTTIN, syscall.SIGTTOU:
+
+		default:
+			syscall.Kill(pid, sig.(syscall.Signal))
+		}
+	}
+}
+
+// exit code like a shell reports it
+func exitCode(ws syscall.WaitStatus) int {
+	if ws.Signaled() {
+		return 128 + int(ws.Signal())
+	}
+	return ws.ExitStatus()
+}
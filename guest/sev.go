@@ -15,22 +15,44 @@ import (
 	"os"
 )
 
-func sev() {
+// raw sev-snp attestation report binding reportData
+func attestationReport(reportData [64]byte) ([]byte, error) {
+
 	dev, err := client.OpenDevice()
 	if err != nil {
-		log.Warnf("sev: %v", err)
-		return
+		return nil, fmt.Errorf("sev: %w", err)
 	}
 	defer dev.Close()
 
+	report, err := client.GetRawReportAtVmpl(dev, reportData, 0)
+	if err != nil {
+		return nil, fmt.Errorf("sev: GetRawReportAtVmpl: %w", err)
+	}
+
+	return report, nil
+}
+
+// the host-data the vmm launched us with, as measured by the firmware
+func reportHostData(report []byte) ([]byte, error) {
+
+	p, err := abi.ReportToProto(report)
+	if err != nil {
+		return nil, fmt.Errorf("sev: ReportToProto: %w", err)
+	}
+
+	return p.HostData, nil
+}
+
+func sev() {
+
 	var reportData [64]byte
 	var hasher = sha256.New()
 	json.NewEncoder(hasher).Encode(CONFIG)
 	hasher.Sum(reportData[:0])
 
-	report, err := client.GetRawReportAtVmpl(dev, reportData, 0)
+	report, err := attestationReport(reportData)
 	if err != nil {
-		log.Error("sev: GetRawReportAtVmpl: ", err)
+		log.Warn(err)
 		return
 	}
 
@@ -46,10 +68,10 @@ func sev() {
 
 	//post it to the url given in env
 	var url = ""
-	for _, container := range CONFIG.Pod.Containers {
-		for k, v := range container.Process.Env {
-			if k == "KR_ATTESTATION_URL" {
-				url = v
+	for _, container := range CONFIG.Containers {
+		for _, v := range container.Process.Env {
+			if v.Name == "KR_ATTESTATION_URL" {
+				url = v.Value
 			}
 		}
 	}
@@ -0,0 +1,101 @@
+// Copyright (c) 2020-present devguard GmbH
+
+package main
+
+import (
+	"fmt"
+	"github.com/kraudcloud/cradle/spec"
+	"golang.org/x/sys/unix"
+	"os"
+	"strings"
+	"syscall"
+)
+
+// guest wide sysctls
+func sysctls() {
+	for _, s := range CONFIG.Sysctls {
+		err := sysctl(s)
+		if err != nil {
+			log.Errorf("sysctl: %v", err)
+		}
+	}
+}
+
+// sysctls that belong to the ipc or uts namespace of a container.
+// kernel.hostname is not one of them, the hostname is always the container name
+func namespacedSysctl(name string) bool {
+
+	switch name {
+	case "kernel.shmmax", "kernel.shmall", "kernel.shmmni", "kernel.shm_rmid_forced",
+		"kernel.msgmax", "kernel.msgmnb", "kernel.msgmni", "kernel.sem",
+		"kernel.domainname":
+		return true
+	}
+
+	return strings.HasPrefix(name, "fs.mqueue.")
+}
+
+// apply container sysctls. must be called from within the containers namespaces
+func containerSysctls(container spec.Container) {
+	for _, s := range container.Sysctls {
+		if !namespacedSysctl(s.Name) {
+			log.Errorf("sysctl: %s is not namespaced, set it for the whole pod instead", s.Name)
+			continue
+		}
+		err := sysctl(s)
+		if err != nil {
+			log.Errorf("sysctl: %v", err)
+		}
+	}
+}
+
+func sysctl(s spec.Sysctl) error {
+
+	if strings.Contains(s.Name, "..") {
+		return fmt.Errorf("invalid sysctl %s", s.Name)
+	}
+
+	err := os.WriteFile("/proc/sys/"+strings.ReplaceAll(s.Name, ".", "/"), []byte(s.Value), 0644)
+	if err != nil {
+		return fmt.Errorf("%s: %w", s.Name, err)
+	}
+
+	return nil
+}
+
+var RLIMITS = map[string]int{
+	"as":         unix.RLIMIT_AS,
+	"core":       unix.RLIMIT_CORE,
+	"cpu":        unix.RLIMIT_CPU,
+	"data":       unix.RLIMIT_DATA,
+	"fsize":      unix.RLIMIT_FSIZE,
+	"locks":      unix.RLIMIT_LOCKS,
+	"memlock":    unix.RLIMIT_MEMLOCK,
+	"msgqueue":   unix.RLIMIT_MSGQUEUE,
+	"nice":       unix.RLIMIT_NICE,
+	"nofile":     unix.RLIMIT_NOFILE,
+	"nproc":      unix.RLIMIT_NPROC,
+	"rss":        unix.RLIMIT_RSS,
+	"rtprio":     unix.RLIMIT_RTPRIO,
+	"rttime":     unix.RLIMIT_RTTIME,
+	"sigpending": unix.RLIMIT_SIGPENDING,
+	"stack":      unix.RLIMIT_STACK,
+}
+
+// apply rlimits to the current process, so they're inherited across exec
+func rlimits(limits []spec.Rlimit) {
+	for _, l := range limits {
+
+		resource, ok := RLIMITS[strings.TrimPrefix(strings.ToLower(l.Type), "rlimit_")]
+		if !ok {
+			log.Errorf("rlimit: unknown type %s", l.Type)
+			continue
+		}
+
+		// not unix.Setrlimit, the go runtime only skips restoring its nofile limit on exec for this one
+		err := syscall.Setrlimit(resource, &syscall.Rlimit{Cur: l.Soft, Max: l.Hard})
+		if err != nil {
+			log.Errorf("rlimit %s: %v", l.Type, err)
+		}
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"github.com/sirupsen/logrus"
 	"os"
+	"sort"
 	"strings"
 )
 
@@ -30,23 +31,36 @@ func (f *Formatter) Format(entry *logrus.Entry) ([]byte, error) {
 		prefix = "<6>"
 	}
 
-	m := strings.TrimFunc(entry.Message, func(c rune) bool {
-		return !(('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z') || ('0' <= c && c <= '9') || c == ' ' || c == '\033')
-	})
+	// kmsg is one record per write, so keep the message as it is and only drop the trailing newline
+	m := prefix + strings.TrimRight(entry.Message, "\r\n")
 
-	m = fmt.Sprintf("%s%s", prefix, m)
-	if !strings.HasSuffix(m, "\n") {
-		m += "\n"
+	for _, k := range sortedFields(entry.Data) {
+		m += fmt.Sprintf(" %s=%v", k, entry.Data[k])
 	}
+
+	m += "\n"
 	return []byte(m), nil
 }
 
+func sortedFields(data logrus.Fields) []string {
+	keys := make([]string, 0, len(data))
+	for k := range data {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
 var log = &logrus.Logger{
 	Level:     logrus.InfoLevel,
 	Out:       os.Stderr,
 	Formatter: &logrus.TextFormatter{},
+	Hooks:     make(logrus.LevelHooks),
 }
 
+// our records are tagged on every line, so the vmm can tell them from the kernels own on the console
+const kmsgTag = "init: "
+
 type KmsgWriter struct {
 }
 
@@ -55,7 +69,15 @@ func (w *KmsgWriter) Write(p []byte) (n int, err error) {
 	if err != nil {
 		return 0, err
 	}
-	lo.Write(p)
+
+	// keep the "<4>" level prefix of Formatter in front
+	msg := strings.TrimRight(string(p), "\n")
+	prefix := ""
+	if len(msg) >= 3 && msg[0] == '<' && msg[2] == '>' {
+		prefix, msg = msg[:3], msg[3:]
+	}
+
+	lo.Write([]byte(prefix + kmsgTag + strings.ReplaceAll(msg, "\n", "\n"+kmsgTag) + "\n"))
 	lo.Close()
 
 	return len(p), nil
@@ -0,0 +1,107 @@
+// Copyright (c) 2020-present devguard GmbH
+
+package main
+
+import (
+	"bytes"
+	"golang.org/x/sys/unix"
+	"strings"
+	"sync"
+)
+
+// kernel device events, since there is no udev in the guest
+type Uevent struct {
+	Action    string
+	Devpath   string
+	Subsystem string
+	Env       map[string]string
+}
+
+var UEVENT_HANDLERS []func(*Uevent)
+var UEVENT_LOCK sync.Mutex
+
+func onUevent(handler func(*Uevent)) {
+	UEVENT_LOCK.Lock()
+	defer UEVENT_LOCK.Unlock()
+
+	UEVENT_HANDLERS = append(UEVENT_HANDLERS, handler)
+}
+
+func uevents() {
+
+	fd, err := unix.Socket(unix.AF_NETLINK, unix.SOCK_RAW|unix.SOCK_CLOEXEC, unix.NETLINK_KOBJECT_UEVENT)
+	if err != nil {
+		log.Errorf("uevent: socket: %v", err)
+		return
+	}
+
+	err = unix.Bind(fd, &unix.SockaddrNetlink{
+		Family: unix.AF_NETLINK,
+		Groups: 1,
+	})
+	if err != nil {
+		unix.Close(fd)
+		log.Errorf("uevent: bind: %v", err)
+		return
+	}
+
+	go func() {
+		defer unix.Close(fd)
+
+		buf := make([]byte, 64*1024)
+		for {
+			n, _, err := unix.Recvfrom(fd, buf, 0)
+			if err != nil {
+				if err == unix.EINTR || err == unix.ENOBUFS {
+					continue
+				}
+				log.Errorf("uevent: recv: %v", err)
+				return
+			}
+
+			ev := parseUevent(buf[:n])
+			if ev == nil {
+				continue
+			}
+
+			UEVENT_LOCK.Lock()
+			handlers := UEVENT_HANDLERS
+			UEVENT_LOCK.Unlock()
+
+			for _, h := range handlers {
+				h(ev)
+			}
+		}
+	}()
+}
+
+// ACTION@DEVPATH\0KEY=VALUE\0...
+func parseUevent(b []byte) *Uevent {
+
+	parts := bytes.Split(b, []byte{0})
+	if len(parts) < 2 {
+		return nil
+	}
+
+	// udev rebroadcasts start with libudev, we only want the kernel ones
+	if !bytes.Contains(parts[0], []byte("@")) {
+		return nil
+	}
+
+	ev := &Uevent{
+		Env: make(map[string]string),
+	}
+
+	for _, p := range parts[1:] {
+		k, v, ok := strings.Cut(string(p), "=")
+		if ok {
+			ev.Env[k] = v
+		}
+	}
+
+	ev.Action = ev.Env["ACTION"]
+	ev.Devpath = ev.Env["DEVPATH"]
+	ev.Subsystem = ev.Env["SUBSYSTEM"]
+
+	return ev
+}
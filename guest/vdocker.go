@@ -6,9 +6,11 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"github.com/kraudcloud/cradle/spec"
 	"github.com/mdlayher/vsock"
 	"io"
 	"net/http"
+	"sort"
 	"strconv"
 	"strings"
 	"syscall"
@@ -71,6 +73,45 @@ func vdockerHttpHandler() http.HandlerFunc {
 			w.WriteHeader(200)
 			go exit(fmt.Errorf("vmm: %s", r.URL.Query().Get("reason")))
 
+			// volume hotplug
+		} else if len(parts) == 3 && parts[1] == "vmm" && parts[2] == "volumes" && r.Method == "POST" {
+
+			handleVolumeAttach(w, r)
+
+		} else if len(parts) == 4 && parts[1] == "vmm" && parts[2] == "volumes" && r.Method == "DELETE" {
+
+			handleVolumeDetach(w, r, parts[3])
+
+			// all container logs for the vmm stdout
+		} else if len(parts) == 3 && parts[1] == "vmm" && parts[2] == "logs" {
+
+			handleVmmLogs(w, r)
+
+			// boot stages and container state changes
+		} else if len(parts) == 3 && parts[1] == "vmm" && parts[2] == "events" {
+
+			handleVmmEvents(w, r)
+
+			// liveness of init, polled by the vmm
+		} else if len(parts) == 3 && parts[1] == "vmm" && parts[2] == "heartbeat" {
+
+			handleVmmHeartbeat(w, r)
+
+			// readiness of the pod, for k8s probes on the vmm
+		} else if len(parts) == 3 && parts[1] == "vmm" && parts[2] == "ready" {
+
+			handleVmmReady(w, r)
+
+			// pod resize
+		} else if len(parts) == 3 && parts[1] == "vmm" && parts[2] == "resources" && r.Method == "POST" {
+
+			handleVmmResources(w, r)
+
+			// container state and usage for vmm metrics
+		} else if len(parts) == 3 && parts[1] == "vmm" && parts[2] == "stats" {
+
+			handleVmmStats(w, r)
+
 			// list containers
 		} else if len(parts) == 3 && parts[1] == "containers" && parts[2] == "json" {
 
@@ -252,6 +293,43 @@ func vdockerHttpHandler() http.HandlerFunc {
 	}
 }
 
+func handleVolumeAttach(w http.ResponseWriter, r *http.Request) {
+
+	var ref spec.Volume
+	err := json.NewDecoder(r.Body).Decode(&ref)
+	if err != nil || ref.Name == "" {
+		w.WriteHeader(400)
+		writeError(w, "invalid volume")
+		return
+	}
+
+	log.Printf("cradle: vmm attaching volume %s", ref.Name)
+
+	err = attachVolume(ref)
+	if err != nil {
+		log.Errorf("volume: %v", err)
+		w.WriteHeader(500)
+		writeError(w, err.Error())
+		return
+	}
+
+	w.WriteHeader(200)
+}
+
+func handleVolumeDetach(w http.ResponseWriter, r *http.Request, name string) {
+
+	log.Printf("cradle: vmm detaching volume %s", name)
+
+	err := detachVolume(name)
+	if err != nil {
+		w.WriteHeader(409)
+		writeError(w, err.Error())
+		return
+	}
+
+	w.WriteHeader(200)
+}
+
 func handleListContainers(w http.ResponseWriter, r *http.Request) {
 	x := []map[string]interface{}{
 		{
@@ -304,6 +382,7 @@ func handleCradleInspect(w http.ResponseWriter, r *http.Request) {
 			"Status":     "running",
 			"StartedAt":  "2020-05-01T00:00:00Z",
 		},
+		"Memory": memoryStats(),
 	})
 }
 
@@ -396,8 +475,46 @@ func handleContainerLogs(w http.ResponseWriter, r *http.Request, index uint8) {
 	container := CONTAINERS[index]
 	containerSpec := CONFIG.Containers[index]
 
-	follow := r.URL.Query().Get("follow") == "true" || r.URL.Query().Get("follow") == "1"
-	muxed := !containerSpec.Process.Tty && (r.URL.Query().Get("force_raw") == "")
+	q := r.URL.Query()
+
+	follow := q.Get("follow") == "true" || q.Get("follow") == "1"
+	muxed := !containerSpec.Process.Tty && (q.Get("force_raw") == "")
+
+	opts := &LogOptions{
+		Tail:       -1,
+		Timestamps: q.Get("timestamps") == "true" || q.Get("timestamps") == "1",
+		Stdout:     q.Get("stdout") == "true" || q.Get("stdout") == "1",
+		Stderr:     q.Get("stderr") == "true" || q.Get("stderr") == "1",
+	}
+
+	// docker requires one of them, older clients here send neither
+	if !opts.Stdout && !opts.Stderr {
+		opts.Stdout = true
+		opts.Stderr = true
+	}
+
+	var err error
+	opts.Since, err = parseDockerTime(q.Get("since"))
+	if err != nil {
+		w.WriteHeader(400)
+		writeError(w, err.Error())
+		return
+	}
+	opts.Until, err = parseDockerTime(q.Get("until"))
+	if err != nil {
+		w.WriteHeader(400)
+		writeError(w, err.Error())
+		return
+	}
+
+	if tail := q.Get("tail"); tail != "" && tail != "all" {
+		opts.Tail, err = strconv.Atoi(tail)
+		if err != nil || opts.Tail < 0 {
+			w.WriteHeader(400)
+			writeError(w, "invalid tail: "+tail)
+			return
+		}
+	}
 
 	w.WriteHeader(200)
 
@@ -412,18 +529,203 @@ func handleContainerLogs(w http.ResponseWriter, r *http.Request, index uint8) {
 		w2 = &DockerMux{inner: w}
 	}
 
-	container.Log.WriteTo(w2)
+	var until <-chan time.Time
+	if follow && !opts.Until.IsZero() {
+		if time.Now().After(opts.Until) {
+			follow = false
+		} else {
+			until = time.After(time.Until(opts.Until))
+		}
+	}
+
+	if !follow {
+		container.Log.Replay(w2, opts)
+		if flusher, ok := w.(http.Flusher); ok {
+			flusher.Flush()
+		}
+		return
+	}
+
+	err = container.Log.ReplayFollow(w2, opts)
+	defer container.Log.Detach(w2)
+	if err != nil {
+		return
+	}
 	if flusher, ok := w.(http.Flusher); ok {
 		flusher.Flush()
 	}
 
-	if follow { // && !self.stopped {
-		container.Log.Attach(w2)
-		defer container.Log.Detach(w2)
-		<-ctx.Done()
+	select {
+	case <-ctx.Done():
+	case <-until:
 	}
-	return
+}
+
+func handleVmmStats(w http.ResponseWriter, r *http.Request) {
 
+	CONTAINERS_LOCK.Lock()
+	containers := append([]*Container(nil), CONTAINERS...)
+	CONTAINERS_LOCK.Unlock()
+
+	var stats []map[string]interface{}
+	for _, c := range containers {
+		if c == nil {
+			continue
+		}
+
+		c.Lock.Lock()
+		stats = append(stats, map[string]interface{}{
+			"Name":     c.Spec.Name,
+			"State":    c.State,
+			"Health":   c.Health,
+			"Restarts": c.Restarts,
+			"ExitCode": c.ExitCode,
+			"Cgroup":   cgroupStats(c.Index),
+		})
+		c.Lock.Unlock()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"Containers": stats,
+		"Memory":     memoryStats(),
+	})
+}
+
+// one line of container output, as streamed to the vmm
+type VmmLogLine struct {
+	Seq       uint64    `json:"seq"`
+	Container string    `json:"container"`
+	Stream    string    `json:"stream"`
+	Time      time.Time `json:"time"`
+	Log       string    `json:"log"`
+}
+
+// stream the output of all containers as json lines, oldest first.
+// lines up to seq after are skipped, so the vmm can resume after reconnecting
+func handleVmmLogs(w http.ResponseWriter, r *http.Request) {
+
+	var after uint64
+	if q := r.URL.Query().Get("after"); q != "" {
+		var err error
+		after, err = strconv.ParseUint(q, 10, 64)
+		if err != nil {
+			w.WriteHeader(400)
+			writeError(w, err.Error())
+			return
+		}
+	}
+
+	type tapped struct {
+		name  string
+		entry LogEntry
+	}
+
+	// dropping lines is better than blocking containers on a slow vmm
+	ch := make(chan tapped, 4096)
+
+	CONTAINERS_LOCK.Lock()
+	containers := append([]*Container(nil), CONTAINERS...)
+	CONTAINERS_LOCK.Unlock()
+
+	var replay []tapped
+	for _, c := range containers {
+		if c == nil {
+			continue
+		}
+		name := c.Spec.Name
+
+		entries, id := c.Log.TapEntries(func(e LogEntry) {
+			select {
+			case ch <- tapped{name, e}:
+			default:
+			}
+		})
+		defer c.Log.Untap(id)
+
+		for _, e := range entries {
+			if e.Seq > after {
+				replay = append(replay, tapped{name, e})
+			}
+		}
+	}
+
+	sort.Slice(replay, func(i, j int) bool {
+		return replay[i].entry.Seq < replay[j].entry.Seq
+	})
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(200)
+
+	enc := json.NewEncoder(w)
+	flusher, _ := w.(http.Flusher)
+
+	write := func(t tapped) error {
+		stream := "stdout"
+		if t.entry.Stream == 2 {
+			stream = "stderr"
+		}
+		err := enc.Encode(VmmLogLine{
+			Seq:       t.entry.Seq,
+			Container: t.name,
+			Stream:    stream,
+			Time:      t.entry.Time,
+			Log:       redact(string(t.entry.Data)),
+		})
+		if flusher != nil {
+			flusher.Flush()
+		}
+		return err
+	}
+
+	for _, t := range replay {
+		if write(t) != nil {
+			return
+		}
+	}
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case t := <-ch:
+			if write(t) != nil {
+				return
+			}
+		}
+	}
+}
+
+// docker sends unix timestamps with optional nanoseconds, like 1700000000.000000000
+func parseDockerTime(s string) (time.Time, error) {
+
+	if s == "" || s == "0" {
+		return time.Time{}, nil
+	}
+
+	if t, err := time.Parse(time.RFC3339Nano, s); err == nil {
+		return t, nil
+	}
+
+	sec, nsec, _ := strings.Cut(s, ".")
+
+	secs, err := strconv.ParseInt(sec, 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid timestamp: %s", s)
+	}
+
+	var nsecs int64
+	if nsec != "" {
+		for len(nsec) < 9 {
+			nsec += "0"
+		}
+		nsecs, err = strconv.ParseInt(nsec[:9], 10, 64)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("invalid timestamp: %s", s)
+		}
+	}
+
+	return time.Unix(secs, nsecs), nil
 }
 
 func handleContainerAttach(w http.ResponseWriter, r *http.Request, index uint8) {
@@ -448,7 +750,7 @@ func handleContainerAttach(w http.ResponseWriter, r *http.Request, index uint8)
 		w2 = &DockerMux{inner: conn, reader: rb}
 	}
 
-	container.Log.WriteTo(w2)
+	container.Log.Replay(w2, LOG_ALL)
 	if flusher, ok := w2.(http.Flusher); ok {
 		flusher.Flush()
 	}
@@ -539,7 +841,7 @@ func findContainer(id string) (uint8, error) {
 	return 0, fmt.Errorf("no such container")
 }
 
-func findExec(id string) (uint8, error) {
+func findExec(id string) (uint32, error) {
 	var vv = strings.Split(id, ".")
 	if len(vv) != 3 {
 		return 0, fmt.Errorf("invalid exec id")
@@ -548,7 +850,7 @@ func findExec(id string) (uint8, error) {
 		return 0, fmt.Errorf("exec on wrong pod")
 	}
 
-	index, err := strconv.ParseUint(vv[2], 10, 8)
+	index, err := strconv.ParseUint(vv[2], 10, 32)
 	if err != nil {
 		return 0, fmt.Errorf("invalid exec id")
 	}
@@ -556,11 +858,11 @@ func findExec(id string) (uint8, error) {
 	EXECS_LOCK.Lock()
 	defer EXECS_LOCK.Unlock()
 
-	if int(index) >= len(EXECS) || EXECS[uint8(index)] == nil {
+	if EXECS[uint32(index)] == nil {
 		return 0, fmt.Errorf("no such exec")
 	}
 
-	return uint8(index), nil
+	return uint32(index), nil
 }
 
 func handleCradleKrShell(w http.ResponseWriter, r *http.Request) {
@@ -620,6 +922,8 @@ func dmesg(ctx context.Context, w io.Writer, follow bool) {
 			uq = msg.Message
 		}
 
+		uq = redact(uq)
+
 		if msg.Priority < 9 {
 			// cut off after \n similar to default tty log
 			if i := strings.Index(uq, "\n"); i != -1 {
@@ -646,20 +950,20 @@ func handleCradleExec(w http.ResponseWriter, r *http.Request) {
 		writeError(w, err.Error())
 		return
 	}
+	if len(req.Cmd) == 0 {
+		w.WriteHeader(400)
+		writeError(w, "no command specified")
+		return
+	}
 
 	EXECS_LOCK.Lock()
 	defer EXECS_LOCK.Unlock()
 
 	req.host = true
-	for i := uint8(0); i < 255; i++ {
-		if EXECS[i] == nil {
-			EXECS[i] = req
-			w.WriteHeader(201)
-			w.Write([]byte(fmt.Sprintf(`{"Id":"exec.%s.%d"}`, CONFIG.ID, i)))
-			return
-		}
-	}
-	w.WriteHeader(429)
+	i := addExec(req)
+
+	w.WriteHeader(201)
+	w.Write([]byte(fmt.Sprintf(`{"Id":"exec.%s.%d"}`, CONFIG.ID, i)))
 }
 
 func handleContainerExec(w http.ResponseWriter, r *http.Request, index uint8) {
@@ -671,6 +975,11 @@ func handleContainerExec(w http.ResponseWriter, r *http.Request, index uint8) {
 		writeError(w, err.Error())
 		return
 	}
+	if len(req.Cmd) == 0 {
+		w.WriteHeader(400)
+		writeError(w, "no command specified")
+		return
+	}
 
 	req.containerIndex = index
 
@@ -693,19 +1002,13 @@ func handleContainerExec(w http.ResponseWriter, r *http.Request, index uint8) {
 	EXECS_LOCK.Lock()
 	defer EXECS_LOCK.Unlock()
 
-	for i := uint8(0); i < 255; i++ {
-		if EXECS[i] == nil {
-			EXECS[i] = req
-			w.WriteHeader(201)
-			w.Write([]byte(fmt.Sprintf(`{"Id":"exec.%s.%d"}`, CONFIG.ID, i)))
-			return
-		}
-	}
+	i := addExec(req)
 
-	w.WriteHeader(429)
+	w.WriteHeader(201)
+	w.Write([]byte(fmt.Sprintf(`{"Id":"exec.%s.%d"}`, CONFIG.ID, i)))
 }
 
-func handleExecStart(w http.ResponseWriter, r *http.Request, execn uint8) {
+func handleExecStart(w http.ResponseWriter, r *http.Request, execn uint32) {
 
 	var execbody = struct {
 		Detach bool
@@ -721,16 +1024,26 @@ func handleExecStart(w http.ResponseWriter, r *http.Request, execn uint8) {
 	EXECS_LOCK.Lock()
 	defer EXECS_LOCK.Unlock()
 
-	if EXECS[execn] == nil {
+	e := EXECS[execn]
+	if e == nil {
 		w.WriteHeader(404)
 		return
 	}
 
-	if EXECS[execn].running {
+	if e.running {
 		w.WriteHeader(409)
 		return
 	}
-	EXECS[execn].running = true
+	e.running = true
+
+	if execbody.Detach {
+		e.AttachStdin = false
+		e.AttachStdout = false
+		e.AttachStderr = false
+		w.WriteHeader(200)
+		go e.Run(nopWriteCloser{io.Discard}, strings.NewReader(""))
+		return
+	}
 
 	conn, rr, err := w.(http.Hijacker).Hijack()
 	if err != nil {
@@ -745,45 +1058,71 @@ func handleExecStart(w http.ResponseWriter, r *http.Request, execn uint8) {
 
 	var w2 io.ReadWriteCloser = conn
 	var reader io.Reader = rr
-	if !EXECS[execn].Tty && (r.URL.Query().Get("force_raw") == "") {
+	if !e.Tty && (r.URL.Query().Get("force_raw") == "") {
 		w2 = &DockerMux{inner: conn, reader: rr}
 		// this is confusing. docker cli expects to receive the wrapper but doesnt send it
 		// reader = w2
 	}
 
-	go EXECS[execn].Run(w2, reader)
+	go e.Run(w2, reader)
+}
+
+type nopWriteCloser struct {
+	io.Writer
 }
 
-func handleExecInspect(w http.ResponseWriter, r *http.Request, execn uint8) {
+func (nopWriteCloser) Close() error { return nil }
+
+func handleExecInspect(w http.ResponseWriter, r *http.Request, execn uint32) {
 
 	EXECS_LOCK.Lock()
 	defer EXECS_LOCK.Unlock()
 
+	e := EXECS[execn]
+	if e == nil {
+		w.WriteHeader(404)
+		writeError(w, "no such exec")
+		return
+	}
+
+	containerID := fmt.Sprintf("container.%d", e.containerIndex)
+	if e.host {
+		containerID = "cradle"
+	}
+
+	pid := 0
+	if e.proc != nil && e.running {
+		pid = e.proc.Pid
+	}
+
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(200)
 	json.NewEncoder(w).Encode(map[string]interface{}{
 		"CanRemove":    false,
-		"ContainerID":  fmt.Sprintf("container.%d", EXECS[execn].containerIndex),
-		"Id":           fmt.Sprintf("exec.%d", execn),
-		"Running":      EXECS[execn].running,
-		"ExitCode":     EXECS[execn].exitcode,
-		"AttachStdin":  true,
-		"AttachStderr": true,
-		"AttachStdout": true,
-		"OpenStdin":    true,
-		"OpenStderr":   true,
-		"OpenStdout":   true,
+		"ContainerID":  containerID,
+		"Id":           fmt.Sprintf("exec.%s.%d", CONFIG.ID, execn),
+		"Running":      e.running,
+		"ExitCode":     e.exitcode,
+		"Pid":          pid,
+		"AttachStdin":  e.AttachStdin,
+		"AttachStderr": e.AttachStderr,
+		"AttachStdout": e.AttachStdout,
+		"OpenStdin":    e.AttachStdin,
+		"OpenStderr":   e.AttachStderr,
+		"OpenStdout":   e.AttachStdout,
 		"ProcessConfig": map[string]interface{}{
-			"entrypoint": EXECS[execn].Cmd[0],
-			"arguments":  EXECS[execn].Cmd[1:],
-			"privileged": EXECS[execn].host,
-			"tty":        EXECS[execn].Tty,
+			"entrypoint": e.Cmd[0],
+			"arguments":  e.Cmd[1:],
+			// cradle containers run with all capabilities anyway
+			"privileged": e.Privileged || e.host,
+			"tty":        e.Tty,
+			"user":       e.User,
 		},
 	})
 
 }
 
-func handleExecResize(w http.ResponseWriter, r *http.Request, index uint8) {
+func handleExecResize(w http.ResponseWriter, r *http.Request, index uint32) {
 
 	EXECS_LOCK.Lock()
 	defer EXECS_LOCK.Unlock()
@@ -801,6 +1140,11 @@ func handleExecResize(w http.ResponseWriter, r *http.Request, index uint8) {
 		vh = 24
 	}
 
+	if EXECS[index] == nil {
+		w.WriteHeader(404)
+		return
+	}
+
 	EXECS[index].Resize(uint16(vw), uint16(vh))
 
 }
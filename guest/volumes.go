@@ -3,6 +3,7 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"github.com/kraudcloud/cradle/spec"
 	"golang.org/x/sys/unix"
@@ -10,21 +11,18 @@ import (
 	"math/rand"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 )
 
-func luksFormat(device string) {
-	fmt.Println("Format device", device)
-	cmd := exec.Command("cryptsetup", "luksFormat", device)
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	err := cmd.Run()
-	if err != nil {
-		fmt.Println(err)
-	}
-}
+var VOLUMES_LOCK sync.Mutex
+
+// mounted block volumes and the cancel func of their sync loop
+var VOLUMES_MOUNTED = make(map[string]context.CancelFunc)
 
 func fileVolumes() {
 	os.MkdirAll("/var/lib/docker/volumes/", 0755)
@@ -65,127 +63,268 @@ func blockVolumes() {
 	}
 
 	for _, f := range iter {
-		name := strings.Split(f.Name(), ".")
-
-		if len(name) < 2 {
-			continue
+		_, err := blockVolume(f.Name())
+		if err != nil {
+			log.Errorf("volume: %v", err)
 		}
+	}
+}
 
-		uuid := name[0]
+// probe, format and mount a volume from /dev/disk/volume/
+// returns the volume name if it was mounted, and no error if there was nothing to mount
+func blockVolume(devname string) (string, error) {
 
-		if name[len(name)-1] != "img" {
-			continue
+	name := strings.Split(devname, ".")
+
+	if len(name) < 2 {
+		return "", nil
+	}
+
+	uuid := name[0]
+
+	if name[len(name)-1] != "img" {
+		return "", nil
+	}
+
+	VOLUMES_LOCK.Lock()
+	defer VOLUMES_LOCK.Unlock()
+
+	var ref spec.Volume
+	for _, v := range CONFIG.Volumes {
+		if v.Name == uuid {
+			ref = v
+			break
 		}
+	}
 
-		var ref spec.Volume
-		for _, v := range CONFIG.Volumes {
-			if v.Name == uuid {
-				ref = v
+	if ref.Name == "" {
+		return "", nil
+	}
+
+	if _, ok := VOLUMES_MOUNTED[ref.Name]; ok {
+		return "", nil
+	}
+
+	os.Symlink("/dev/disk/volume/"+devname, "/dev/disk/volume/"+ref.Name)
+
+	device := "/dev/disk/volume/" + devname
+
+	blkid, err := probeVolume(device)
+	if err != nil {
+		return "", fmt.Errorf("%s: %w", ref.Name, err)
+	}
+
+	log.Printf("cradle: volume %s probed: %s", uuid, blkid)
+
+	// if its not mounted, dont touch it. user might do weird things
+	isMounted := false
+	for _, container := range CONFIG.Containers {
+		for _, m := range container.VolumeMounts {
+			if m.VolumeName == ref.Name {
+				isMounted = true
 				break
 			}
 		}
+	}
+	if !isMounted {
+		return "", nil
+	}
 
-		if ref.Name == "" {
-			continue
+	if ref.Encryption != nil {
+		device, err = luksOpen(ref, device, blkid)
+		if err != nil {
+			return "", fmt.Errorf("%s: %w", ref.Name, err)
 		}
 
-		os.Symlink("/dev/disk/volume/"+f.Name(), "/dev/disk/volume/"+ref.Name)
+		blkid, err = probeVolume(device)
+		if err != nil {
+			luksClose(ref.Name)
+			return "", fmt.Errorf("%s: %w", ref.Name, err)
+		}
+	}
 
-		cmd := exec.Command("/sbin/blkid", "/dev/disk/volume/"+f.Name())
-		out, err := cmd.Output()
+	if blkid == "" {
+		log.Printf("cradle: formatting volume %s", uuid)
+		err = mkfs(device, "volume")
 		if err != nil {
-			log.Errorf("blkid: %v", err)
-			continue
+			return "", fmt.Errorf("%s: mkfs.xfs: %w", ref.Name, err)
+		}
+		blkid = "xfs"
+	}
+
+	os.MkdirAll("/var/lib/docker/volumes/"+ref.Name, 0755)
+
+	if blkid == "ext4" {
+		err = syscall.Mount(device, "/var/lib/docker/volumes/"+ref.Name+"/", "ext4", 0, "")
+		if err != nil {
+			return "", fmt.Errorf("%s: mount: %w", ref.Name, err)
+		}
+	} else if blkid == "xfs" {
+		err = syscall.Mount(device, "/var/lib/docker/volumes/"+ref.Name+"/", "xfs", 0, "")
+		if err != nil {
+			return "", fmt.Errorf("%s: mount: %w", ref.Name, err)
 		}
+	} else {
+		return "", fmt.Errorf("%s: unknown filesystem '%s'", ref.Name, blkid)
+	}
 
-		var blkid string
-		split := strings.Split(string(out), " ")
-		for _, s := range split {
-			if strings.HasPrefix(s, "TYPE=") {
-				blkid = strings.TrimSpace(strings.TrimPrefix(s, "TYPE="))
-				blkid = strings.Trim(blkid, "\"")
+	os.MkdirAll("/var/lib/docker/volumes/"+ref.Name+"/_data", 0755)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	VOLUMES_MOUNTED[ref.Name] = cancel
+
+	mountedTo := "/var/lib/docker/volumes/" + ref.Name + "/"
+	go func() {
+		// FIXME something is conceptually wrong here
+		// sometimes we loose a vm before it can flush, that's just the rough reality of hardware.
+		// i don't understand how this is ever supposed to work.
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(time.Second + (time.Duration(rand.Intn(500)) * time.Millisecond)):
 			}
+			syncfs(mountedTo)
 		}
+	}()
 
-		log.Printf("cradle: volume %s probed: %s", uuid, blkid)
+	return ref.Name, nil
+}
 
-		if blkid == "" {
-			// double check that its empty, and we arent just failing elsewhere
-			f, err := os.Open("/dev/disk/volume/" + f.Name())
-			if err != nil {
-				log.Errorf("volume: %v", err)
-				continue
-			}
+// the directory of a volume mount in the cradle
+func volumePath(m spec.VolumeMount) string {
+	return filepath.Join("/var/lib/docker/volumes/", m.VolumeName, "_data", m.VolumePath)
+}
 
-			buf := make([]byte, 4096)
-			_, err = f.Read(buf)
-			if err != nil {
-				log.Errorf("volume: %v", err)
-				continue
-			}
+// create the directory of a volume mount with the requested owner and mode
+func prepareVolumePath(m spec.VolumeMount) string {
 
-			if !allzero(buf) {
-				log.Warnf("volume: %s has unknown filesystem, refusing to touch it", uuid)
-				continue
-			}
+	vp := volumePath(m)
+	os.MkdirAll(vp, 0755)
+
+	// -1 leaves the owner alone
+	uid, gid := -1, -1
+	if m.Uid != nil {
+		uid = *m.Uid
+	}
+	if m.Gid != nil {
+		gid = *m.Gid
+	}
+	if uid != -1 || gid != -1 {
+		err := os.Chown(vp, uid, gid)
+		if err != nil {
+			log.Warnf("volume: chown %s: %v", vp, err)
 		}
+	}
 
-		// if its not mounted, dont touch it. user might do weird things
-		isMounted := false
-		for _, container := range CONFIG.Containers {
-			for _, m := range container.VolumeMounts {
-				if m.VolumeName == ref.Name {
-					isMounted = true
-					break
-				}
-			}
+	if m.Mode != "" {
+		mode, err := strconv.ParseUint(m.Mode, 8, 32)
+		if err != nil {
+			log.Warnf("volume: invalid mode '%s' for %s", m.Mode, vp)
+		} else {
+			os.Chmod(vp, os.FileMode(mode))
 		}
-		if !isMounted {
+	}
+
+	return vp
+}
+
+// volumes without device or transport live in guest memory or on the cache disk
+func ephemeralVolumes() {
+
+	os.MkdirAll("/var/lib/docker/volumes/", 0755)
+
+	VOLUMES_LOCK.Lock()
+	defer VOLUMES_LOCK.Unlock()
+
+	for _, ref := range CONFIG.Volumes {
+
+		if ref.DevicePath != "" || ref.Transport != "" {
 			continue
 		}
 
-		if blkid == "" {
-			log.Printf("cradle: formatting volume %s", uuid)
-			err = mkfs("/dev/disk/volume/"+f.Name(), "volume")
-			if err != nil {
-				log.Errorf("mkfs.xfs: %v", err)
-				continue
-			}
-			blkid = "xfs"
-		}
+		mountedTo := "/var/lib/docker/volumes/" + ref.Name
+		os.MkdirAll(mountedTo, 0755)
 
-		os.MkdirAll("/var/lib/docker/volumes/"+ref.Name, 0755)
+		medium := ref.Medium
+		if medium == "" {
+			medium = "cache"
+		}
 
-		if blkid == "ext4" {
-			err = syscall.Mount("/dev/disk/volume/"+f.Name(), "/var/lib/docker/volumes/"+ref.Name+"/", "ext4", 0, "")
+		switch medium {
+		case "tmpfs":
+			opts := "mode=0755"
+			if ref.SizeLimit > 0 {
+				opts += fmt.Sprintf(",size=%dm", ref.SizeLimit)
+			}
+			err := syscall.Mount("tmpfs", mountedTo, "tmpfs", syscall.MS_NOSUID|syscall.MS_NODEV, opts)
 			if err != nil {
-				log.Errorf("mount: %v", err)
+				log.Errorf("volume: mount tmpfs %s: %v", ref.Name, err)
 				continue
 			}
-		} else if blkid == "xfs" {
-			err = syscall.Mount("/dev/disk/volume/"+f.Name(), "/var/lib/docker/volumes/"+ref.Name+"/", "xfs", 0, "")
+
+		case "cache":
+			cache := "/cache/volumes/" + ref.Name
+			os.MkdirAll(cache, 0755)
+			err := syscall.Mount(cache, mountedTo, "", syscall.MS_BIND, "")
 			if err != nil {
-				log.Errorf("mount: %v", err)
+				log.Errorf("volume: bind %s: %v", ref.Name, err)
 				continue
 			}
-		} else {
-			log.Warn("unknown filesystem '" + blkid + "'")
+
+		default:
+			log.Errorf("volume: %s has unknown medium '%s'", ref.Name, ref.Medium)
 			continue
 		}
 
-		os.MkdirAll("/var/lib/docker/volumes/"+ref.Name+"/_data", 0755)
+		os.MkdirAll(mountedTo+"/_data", 0755)
 
-		mountedTo := "/var/lib/docker/volumes/" + ref.Name + "/"
-		go func() {
-			// FIXME something is conceptually wrong here
-			// sometimes we loose a vm before it can flush, that's just the rough reality of hardware.
-			// i don't understand how this is ever supposed to work.
-			for {
-				time.Sleep(time.Second + (time.Duration(rand.Intn(500)) * time.Millisecond))
-				syncfs(mountedTo)
-			}
-		}()
+		log.Printf("cradle: ephemeral volume %s on %s", ref.Name, medium)
+	}
+}
+
+// filesystem type of a device, empty if the device is blank.
+// fails if the device can't be read or has content blkid doesn't understand
+func probeVolume(device string) (string, error) {
+
+	cmd := exec.Command("/sbin/blkid", device)
+	out, err := cmd.Output()
+	if err != nil {
+		// blkid exits 2 if it found nothing
+		if exit, ok := err.(*exec.ExitError); !ok || exit.ExitCode() != 2 {
+			return "", fmt.Errorf("blkid: %w", err)
+		}
+	}
+
+	var blkid string
+	split := strings.Split(string(out), " ")
+	for _, s := range split {
+		if strings.HasPrefix(s, "TYPE=") {
+			blkid = strings.TrimSpace(strings.TrimPrefix(s, "TYPE="))
+			blkid = strings.Trim(blkid, "\"")
+		}
 	}
+
+	if blkid == "" {
+		// double check that its empty, and we arent just failing elsewhere
+		f, err := os.Open(device)
+		if err != nil {
+			return "", err
+		}
+
+		buf := make([]byte, 4096)
+		_, err = f.Read(buf)
+		f.Close()
+		if err != nil {
+			return "", err
+		}
+
+		if !allzero(buf) {
+			return "", fmt.Errorf("%s has unknown filesystem, refusing to touch it", device)
+		}
+	}
+
+	return blkid, nil
 }
 
 func allzero(s []byte) bool {
@@ -218,3 +357,160 @@ func syncfs(path string) {
 		log.Errorf("syncfs: %v", err)
 	}
 }
+
+// mount volumes the vmm hotplugs at runtime
+func volumeHotplug() {
+
+	onUevent(func(ev *Uevent) {
+		if ev.Subsystem != "block" || ev.Action != "add" || ev.Env["DEVNAME"] == "" {
+			return
+		}
+
+		makedevBlock(ev.Env["DEVNAME"])
+
+		iter, err := os.ReadDir("/dev/disk/volume/")
+		if err != nil {
+			return
+		}
+
+		for _, f := range iter {
+			target, err := os.Readlink("/dev/disk/volume/" + f.Name())
+			if err != nil || target != "/dev/"+ev.Env["DEVNAME"] {
+				continue
+			}
+
+			name, err := blockVolume(f.Name())
+			if err != nil {
+				log.Errorf("volume: %v", err)
+			}
+			if name != "" {
+				log.Printf("cradle: hotplugged volume %s", name)
+				bindVolumeIntoContainers(name)
+			}
+		}
+	})
+}
+
+// mount a volume the vmm just hotplugged into the containers that declare it
+func attachVolume(ref spec.Volume) error {
+
+	VOLUMES_LOCK.Lock()
+	known := false
+	for i, v := range CONFIG.Volumes {
+		if v.Name == ref.Name {
+			CONFIG.Volumes[i] = ref
+			known = true
+		}
+	}
+	if !known {
+		CONFIG.Volumes = append(CONFIG.Volumes, ref)
+	}
+	VOLUMES_LOCK.Unlock()
+
+	// makedevBlock links the device when its uevent arrives, which may not have happened yet
+	devname := ref.Name + ".img"
+	for i := 0; ; i++ {
+		if _, err := os.Lstat("/dev/disk/volume/" + devname); err == nil {
+			break
+		}
+		if i == 300 {
+			return fmt.Errorf("%s: device did not show up", ref.Name)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	name, err := blockVolume(devname)
+	if err != nil {
+		return err
+	}
+
+	// empty if the uevent was quicker and already mounted it
+	if name != "" {
+		bindVolumeIntoContainers(name)
+	}
+
+	return nil
+}
+
+// bind a freshly mounted volume into running containers that declare it
+func bindVolumeIntoContainers(name string) {
+
+	CONTAINERS_LOCK.Lock()
+	containers := CONTAINERS
+	CONTAINERS_LOCK.Unlock()
+
+	for _, c := range containers {
+		for _, m := range c.Spec.VolumeMounts {
+
+			if m.VolumeName != name || m.GuestPath == "" || m.GuestPath == "/" {
+				continue
+			}
+
+			vp := prepareVolumePath(m)
+
+			err := bindIntoContainer(c, vp, m.GuestPath, m.ReadOnly)
+			if err != nil {
+				log.Errorf("volume: bind %s into %s: %v", name, c.Spec.Name, err)
+			}
+		}
+	}
+}
+
+// unmount a volume everywhere so the vmm can unplug its device
+func detachVolume(name string) error {
+
+	CONTAINERS_LOCK.Lock()
+	containers := CONTAINERS
+	CONTAINERS_LOCK.Unlock()
+
+	for _, c := range containers {
+		for _, m := range c.Spec.VolumeMounts {
+
+			if m.VolumeName != name || m.GuestPath == "" || m.GuestPath == "/" {
+				continue
+			}
+
+			err := unmountInContainer(c, m.GuestPath)
+			if err != nil {
+				log.Warnf("volume: unmount %s from %s: %v", name, c.Spec.Name, err)
+			}
+		}
+	}
+
+	VOLUMES_LOCK.Lock()
+	defer VOLUMES_LOCK.Unlock()
+
+	if cancel, ok := VOLUMES_MOUNTED[name]; ok {
+		cancel()
+
+		mountedTo := "/var/lib/docker/volumes/" + name + "/"
+		syncfs(mountedTo)
+
+		err := syscall.Unmount(mountedTo, 0)
+		if err != nil {
+			return fmt.Errorf("unmount %s: %w", mountedTo, err)
+		}
+
+		delete(VOLUMES_MOUNTED, name)
+	}
+
+	luksClose(name)
+
+	iter, _ := os.ReadDir("/dev/disk/volume/")
+	for _, f := range iter {
+		if f.Name() == name || strings.HasPrefix(f.Name(), name+".") {
+			os.Remove("/dev/disk/volume/" + f.Name())
+		}
+	}
+
+	for i, v := range CONFIG.Volumes {
+		if v.Name == name {
+			CONFIG.Volumes = append(CONFIG.Volumes[:i], CONFIG.Volumes[i+1:]...)
+			break
+		}
+	}
+
+	log.Printf("cradle: detached volume %s", name)
+
+	return nil
+}
@@ -13,7 +13,8 @@ func wdinit() {
 	if err != nil {
 		log.Warnf("failed to open watchdog: %v", err)
 	} else {
-		unix.IoctlSetInt(int(watchdog.Fd()), unix.WDIOC_SETTIMEOUT, 2)
+		// a busy host can stall the guest for a few seconds, that's not a hang yet
+		unix.IoctlSetInt(int(watchdog.Fd()), unix.WDIOC_SETTIMEOUT, 10)
 		go func() {
 			for {
 				unix.IoctlWatchdogKeepalive(int(watchdog.Fd()))
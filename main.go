@@ -11,6 +11,9 @@ func main() {
 	}
 
 	rootCmd.AddCommand(vmm.RunCMD())
+	rootCmd.AddCommand(vmm.ResizeCMD())
+	rootCmd.AddCommand(vmm.VolumeCMD())
+	rootCmd.AddCommand(vmm.ProbeCMD())
 
 	err := rootCmd.Execute()
 	if err != nil {
@@ -17,6 +17,12 @@ type Firmware struct {
 type Kernel struct {
 	Kernel string `json:"kernel"`
 	Initrd string `json:"initrd"`
+
+	// appended to the default kernel cmdline
+	Cmdline []string `json:"cmdline,omitempty"`
+
+	// loaded by the guest at boot, optionally with parameters: "name key=value"
+	Modules []string `json:"modules,omitempty"`
 }
 
 type Machine struct {
@@ -11,4 +11,8 @@ type CradleLaunchIntentSpec struct {
 	Containers		[]Container	`json:"containers,omitempty" yaml:"containers,omitempty"`
 	Resources		Resources	`json:"resources,omitempty" yaml:"resources,omitempty"`
 	VolumeDevices	[]Volume	`json:"volumeDevices,omitempty" yaml:"volumeDevices,omitempty"`
+	Volumes			[]Volume	`json:"volumes,omitempty" yaml:"volumes,omitempty"`
+	Kernel			KernelConfig	`json:"kernel,omitempty" yaml:"kernel,omitempty"`
+	Sysctls			[]Sysctl	`json:"sysctls,omitempty" yaml:"sysctls,omitempty"`
+	LogExport		*LogExport	`json:"logExport,omitempty" yaml:"logExport,omitempty"`
 }
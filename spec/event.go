@@ -0,0 +1,68 @@
+// Copyright (c) 2020-present devguard GmbH
+
+package spec
+
+import (
+	"time"
+)
+
+// boot stage of the guest, in the order init goes through them
+type Stage uint32
+
+const (
+	STAGE_BOOT Stage = iota
+	STAGE_NETWORK
+	STAGE_LAYERS
+	STAGE_VOLUMES
+	STAGE_POD_UP
+	STAGE_SHUTDOWN
+)
+
+func (s Stage) String() string {
+	switch s {
+	case STAGE_BOOT:
+		return "boot"
+	case STAGE_NETWORK:
+		return "network"
+	case STAGE_LAYERS:
+		return "layers"
+	case STAGE_VOLUMES:
+		return "volumes"
+	case STAGE_POD_UP:
+		return "pod up"
+	case STAGE_SHUTDOWN:
+		return "shutdown"
+	}
+	return "unknown"
+}
+
+const (
+	EVENT_STAGE     = "stage"
+	EVENT_CONTAINER = "container"
+	EVENT_SHUTDOWN  = "shutdown"
+)
+
+// pushed from guest init to the vmm
+type Event struct {
+
+	// increases by one for every event, so the vmm can resume after a reconnect
+	Seq uint64 `json:"seq"`
+
+	Time time.Time `json:"time"`
+
+	// one of EVENT_*
+	Type string `json:"type"`
+
+	Stage Stage `json:"stage"`
+
+	// container events, and shutdowns caused by a critical container
+	Container string `json:"container,omitempty"`
+	State     string `json:"state,omitempty"`
+	ExitCode  int    `json:"exitCode,omitempty"`
+
+	// why a container stopped or the guest is shutting down
+	Reason string `json:"reason,omitempty"`
+
+	// shutdown events caused by a critical container: the tail of its output
+	Output string `json:"output,omitempty"`
+}
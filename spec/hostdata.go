@@ -0,0 +1,45 @@
+// Copyright (c) 2020-present devguard GmbH
+
+package spec
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"sort"
+)
+
+// key brokers of all encrypted volumes, sorted and without duplicates
+func (self *Launch) KeyBrokers() []string {
+
+	seen := make(map[string]bool)
+	var brokers []string
+
+	for _, v := range self.Volumes {
+		if v.Encryption == nil || v.Encryption.KeyBroker == "" || seen[v.Encryption.KeyBroker] {
+			continue
+		}
+		seen[v.Encryption.KeyBroker] = true
+		brokers = append(brokers, v.Encryption.KeyBroker)
+	}
+
+	sort.Strings(brokers)
+
+	return brokers
+}
+
+// the sev-snp host-data of a launch. it ends up in every attestation report,
+// so a key broker can check that the guest was launched to talk to it
+func HostData(id string, keyBrokers []string) []byte {
+
+	data := map[string]interface{}{
+		"ID": id,
+	}
+	if len(keyBrokers) > 0 {
+		data["KeyBrokers"] = keyBrokers
+	}
+
+	h := sha256.New()
+	json.NewEncoder(h).Encode(data)
+
+	return h.Sum(nil)
+}
@@ -13,6 +13,42 @@ type Launch struct {
 	Containers []Container `json:"containers,omitempty" yaml:"containers,omitempty"`
 
 	Volumes []Volume `json:"volumes,omitempty" yaml:"volumes,omitempty"`
+
+	Kernel KernelConfig `json:"kernel,omitempty" yaml:"kernel,omitempty"`
+
+	// guest wide sysctls, applied by init before any container starts
+	Sysctls []Sysctl `json:"sysctls,omitempty" yaml:"sysctls,omitempty"`
+
+	// ship cradle and container logs to a remote collector
+	LogExport *LogExport `json:"logExport,omitempty" yaml:"logExport,omitempty"`
+}
+
+type LogExport struct {
+
+	// "syslog" (rfc5424) or "otlp" (otlp/http with json encoding)
+	Protocol string `json:"protocol" yaml:"protocol"`
+
+	// syslog: tcp://host:port or udp://host:port
+	// otlp: base url of the collector, like http://otel-collector:4318
+	Endpoint string `json:"endpoint" yaml:"endpoint"`
+
+	// extra http headers for otlp, like authorization
+	Headers map[string]string `json:"headers,omitempty" yaml:"headers,omitempty"`
+}
+
+type Sysctl struct {
+	Name  string `json:"name" yaml:"name"`
+	Value string `json:"value" yaml:"value"`
+}
+
+// guest kernel config per deployment, merged with the one from cradle.json
+type KernelConfig struct {
+
+	// appended to the kernel cmdline
+	Cmdline []string `json:"cmdline,omitempty" yaml:"cmdline,omitempty"`
+
+	// loaded by the guest at boot, optionally with parameters: "name key=value"
+	Modules []string `json:"modules,omitempty" yaml:"modules,omitempty"`
 }
 
 type Resources struct {
@@ -31,6 +67,30 @@ type Volume struct {
 
 	// hvm transport mode
 	Transport string `json:"transport,omitempty" yaml:"transport,omitempty"`
+
+	// directory on hvm shared into the guest with transport 9p or virtiofs
+	HostPath string `json:"hostPath,omitempty" yaml:"hostPath,omitempty"`
+
+	// backing of a volume without device or transport:
+	// "cache" (default) is a directory on the cache disk, "tmpfs" is guest memory
+	Medium string `json:"medium,omitempty" yaml:"medium,omitempty"`
+
+	// size limit of tmpfs volumes in MiB. 0 means half of guest memory
+	SizeLimit int `json:"sizeLimit,omitempty" yaml:"sizeLimit,omitempty"`
+
+	// encrypt the block device inside the guest with luks
+	Encryption *VolumeEncryption `json:"encryption,omitempty" yaml:"encryption,omitempty"`
+}
+
+type VolumeEncryption struct {
+
+	// https url the guest posts its sev-snp attestation report to.
+	// the response is the luks passphrase, encrypted to a key the report binds.
+	// brokers of the launch config are part of the sev-snp host-data
+	KeyBroker string `json:"keyBroker" yaml:"keyBroker"`
+
+	// passed to the key broker to select the key, defaults to the volume name
+	KeyID string `json:"keyID,omitempty" yaml:"keyID,omitempty"`
 }
 
 // the container spec
@@ -53,6 +113,38 @@ type Container struct {
 
 	// mount cradle host paths into container
 	KernelMounts []KernelMount `json:"kernelMounts,omitempty" yaml:"kernelMounts,omitempty"`
+
+	// read only files injected into the container, like k8s configmaps and secrets
+	ConfigMounts []ConfigMount `json:"configMounts,omitempty" yaml:"configMounts,omitempty"`
+
+	// where container output goes
+	Logging Logging `json:"logging,omitempty" yaml:"logging,omitempty"`
+
+	// sysctls of the containers ipc and uts namespace, like kernel.shmmax or fs.mqueue.msg_max.
+	// everything else is shared by all containers and goes into Launch.Sysctls
+	Sysctls []Sysctl `json:"sysctls,omitempty" yaml:"sysctls,omitempty"`
+
+	// command run inside the container to decide if it is healthy, like a k8s exec probe.
+	// without one, a running container is considered healthy
+	Healthcheck *Healthcheck `json:"healthcheck,omitempty" yaml:"healthcheck,omitempty"`
+}
+
+type Healthcheck struct {
+
+	// exit code 0 means healthy
+	Cmd []string `json:"cmd" yaml:"cmd"`
+
+	// milliseconds between checks, default 10000
+	Interval uint64 `json:"interval,omitempty" yaml:"interval,omitempty"`
+
+	// milliseconds before a check counts as failed, default 5000
+	Timeout uint64 `json:"timeout,omitempty" yaml:"timeout,omitempty"`
+
+	// milliseconds after start during which failures are not counted
+	StartPeriod uint64 `json:"startPeriod,omitempty" yaml:"startPeriod,omitempty"`
+
+	// consecutive failures before the container is unhealthy, default 3
+	Retries int `json:"retries,omitempty" yaml:"retries,omitempty"`
 }
 
 type Image struct {
@@ -92,16 +184,53 @@ type Process struct {
 
 	// User to run as. defaults to 0
 	User string `json:"user,omitempty" yaml:"user,omitempty"`
+
+	// resource limits, defaults to the kernel defaults
+	Rlimits []Rlimit `json:"rlimits,omitempty" yaml:"rlimits,omitempty"`
+
+	// keep cradle as pid 1 to forward signals and reap zombies, like docker run --init
+	Init bool `json:"init,omitempty" yaml:"init,omitempty"`
+}
+
+type Rlimit struct {
+
+	// nofile, nproc, memlock, core, stack, ... like ulimit
+	Type string `json:"type" yaml:"type"`
+
+	Soft uint64 `json:"soft" yaml:"soft"`
+	Hard uint64 `json:"hard" yaml:"hard"`
 }
 
 type Env struct {
 	Name      string        `json:"name" yaml:"name"`
 	Value     string        `json:"value,omitempty" yaml:"value,omitempty"`
 	ValueFrom *EnvValueFrom `json:"valueFrom,omitempty" yaml:"valueFrom,omitempty"`
+
+	// value is redacted from logs. implied by valueFrom.file
+	Secret bool `json:"secret,omitempty" yaml:"secret,omitempty"`
 }
 
 type EnvValueFrom struct {
 	PodEnv string `json:"podEnv,omitempty" yaml:"podEnv,omitempty"`
+
+	// content of a file on hvm, like a mounted k8s secret
+	File string `json:"file,omitempty" yaml:"file,omitempty"`
+
+	// pod metadata like the k8s downward api:
+	// metadata.name, metadata.namespace, metadata.uid, status.podIP, spec.nodeName
+	FieldRef string `json:"fieldRef,omitempty" yaml:"fieldRef,omitempty"`
+
+	// pod resources like the k8s downward api
+	ResourceFieldRef *ResourceFieldRef `json:"resourceFieldRef,omitempty" yaml:"resourceFieldRef,omitempty"`
+}
+
+type ResourceFieldRef struct {
+
+	// limits.cpu, limits.memory, requests.cpu or requests.memory
+	Resource string `json:"resource" yaml:"resource"`
+
+	// unit of the value, like "1m" or "1Mi". defaults to "1"
+	Divisor string `json:"divisor,omitempty" yaml:"divisor,omitempty"`
 }
 
 type Lifecycle struct {
@@ -141,6 +270,16 @@ type VolumeMount struct {
 
 	// read only
 	ReadOnly bool `json:"readOnly" yaml:"readOnly"`
+
+	// owner of the volume path. left alone if unset
+	Uid *int `json:"uid,omitempty" yaml:"uid,omitempty"`
+	Gid *int `json:"gid,omitempty" yaml:"gid,omitempty"`
+
+	// octal permissions of the volume path, like "0750"
+	Mode string `json:"mode,omitempty" yaml:"mode,omitempty"`
+
+	// do not copy the image content at guestPath into an empty volume
+	NoCopy bool `json:"nocopy,omitempty" yaml:"nocopy,omitempty"`
 }
 
 type KernelMount struct {
@@ -155,6 +294,41 @@ type KernelMount struct {
 	ReadOnly bool `json:"readOnly" yaml:"readOnly"`
 }
 
+type Logging struct {
+
+	// size of the in memory log ring in bytes, served by docker logs. defaults to 1MiB
+	RingSize int `json:"ringSize,omitempty" yaml:"ringSize,omitempty"`
+
+	// "json-file" (default) also writes to /cache/logs/<container>/, "memory" keeps only the ring.
+	// the files outlive the ring but not the vm, the cache disk is formatted on boot
+	Driver string `json:"driver,omitempty" yaml:"driver,omitempty"`
+
+	// rotate log files at this size in bytes. defaults to 10MiB
+	MaxSize int64 `json:"maxSize,omitempty" yaml:"maxSize,omitempty"`
+
+	// number of log files to keep, including the current one. defaults to 5
+	MaxFiles int `json:"maxFiles,omitempty" yaml:"maxFiles,omitempty"`
+}
+
+type ConfigMount struct {
+
+	// path of the file inside the container
+	GuestPath string `json:"guestPath" yaml:"guestPath"`
+
+	// inline file content
+	Content string `json:"content,omitempty" yaml:"content,omitempty"`
+
+	// read the content from this file on hvm instead, like a mounted k8s secret
+	HostPath string `json:"hostPath,omitempty" yaml:"hostPath,omitempty"`
+
+	// octal permissions of the file. defaults to "0444"
+	Mode string `json:"mode,omitempty" yaml:"mode,omitempty"`
+
+	// owner of the file. defaults to 0:0
+	Uid int `json:"uid,omitempty" yaml:"uid,omitempty"`
+	Gid int `json:"gid,omitempty" yaml:"gid,omitempty"`
+}
+
 type Network struct {
 	Nameservers  []string `json:"nameservers,omitempty" yaml:"nameservers,omitempty"`
 	SearchDomain string   `json:"searchDomain,omitempty" yaml:"searchDomain,omitempty"`
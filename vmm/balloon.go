@@ -0,0 +1,44 @@
+// Copyright (c) 2020-present devguard GmbH
+
+package vmm
+
+import (
+	"fmt"
+)
+
+// the balloon only exists on machines where freed guest pages can actually be returned to the host.
+// snp guest memory is encrypted and private to the guest.
+func (self *VM) hasBalloon() bool {
+	return self.CradleGuest.Machine.Type == "microvm"
+}
+
+// set the amount of memory the guest may use. the balloon inflates by the difference to guest ram
+func (self *VM) SetBalloon(mb int) error {
+
+	if !self.hasBalloon() {
+		return fmt.Errorf("balloon not supported on machine type %s", self.CradleGuest.Machine.Type)
+	}
+
+	if mb > self.guestMemory() {
+		mb = self.guestMemory()
+	}
+
+	return self.QMP.Execute("balloon", map[string]interface{}{
+		"value": int64(mb) * 1024 * 1024,
+	}, nil)
+}
+
+// memory currently available to the guest, in MiB
+func (self *VM) QueryBalloon() (int, error) {
+
+	var info struct {
+		Actual int64 `json:"actual"`
+	}
+
+	err := self.QMP.Execute("query-balloon", nil, &info)
+	if err != nil {
+		return 0, err
+	}
+
+	return int(info.Actual / 1024 / 1024), nil
+}
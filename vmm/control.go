@@ -0,0 +1,243 @@
+// Copyright (c) 2020-present devguard GmbH
+
+package vmm
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/kraudcloud/cradle/spec"
+	"github.com/spf13/cobra"
+)
+
+// the vmm control api is http on a unix socket, so other cradle subcommands
+// in the same pod (kubectl exec) can talk to the running vmm
+
+func (self *VM) controlSocketPath() string {
+	return filepath.Join(self.WorkDir, "mgm", "vmm.sock")
+}
+
+func (self *VM) StartControl() error {
+
+	os.Remove(self.controlSocketPath())
+
+	l, err := net.Listen("unix", self.controlSocketPath())
+	if err != nil {
+		return err
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/resize", self.handleResize)
+	mux.HandleFunc("/volumes/", self.handleVolumes)
+	mux.HandleFunc("/probe/ready", self.probeHandler(self.probeReady))
+	mux.HandleFunc("/probe/live", self.probeHandler(self.probeLive))
+
+	go func() {
+		err := http.Serve(l, mux)
+		if err != nil {
+			log.Warn("control: ", err)
+		}
+	}()
+
+	return nil
+}
+
+func (self *VM) handleResize(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	cpu, _ := strconv.Atoi(r.URL.Query().Get("cpu"))
+	mem, _ := strconv.Atoi(r.URL.Query().Get("mem"))
+
+	err := self.Resize(cpu, mem)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintln(w, err.Error())
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// POST /volumes/ with a spec.Volume body attaches, DELETE /volumes/<name> detaches
+func (self *VM) handleVolumes(w http.ResponseWriter, r *http.Request) {
+
+	var err error
+
+	switch r.Method {
+	case "POST":
+		var volume spec.Volume
+		err = json.NewDecoder(r.Body).Decode(&volume)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintln(w, err.Error())
+			return
+		}
+		err = self.AttachVolume(volume)
+
+	case "DELETE":
+		err = self.DetachVolume(strings.TrimPrefix(r.URL.Path, "/volumes/"))
+
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintln(w, err.Error())
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// find the control socket of the vmm running in this pod
+func findControlSocket(arg string) (string, error) {
+
+	if arg != "" {
+		return arg, nil
+	}
+
+	matches, _ := filepath.Glob("/var/run/cradle/pods/*/*/mgm/vmm.sock")
+	if len(matches) == 0 {
+		return "", fmt.Errorf("no running cradle found")
+	}
+	if len(matches) > 1 {
+		return "", fmt.Errorf("multiple cradles running, use --socket")
+	}
+
+	return matches[0], nil
+}
+
+func controlClient(socket string) *http.Client {
+	return &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				return (&net.Dialer{}).DialContext(ctx, "unix", socket)
+			},
+		},
+	}
+}
+
+func controlRequest(socket string, method string, path string, body interface{}) error {
+
+	var rd io.Reader
+	if body != nil {
+		js, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		rd = bytes.NewReader(js)
+	}
+
+	req, err := http.NewRequest(method, "http://vmm"+path, rd)
+	if err != nil {
+		return err
+	}
+
+	resp, err := controlClient(socket).Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+
+	return nil
+}
+
+func ResizeCMD() *cobra.Command {
+
+	var arg_socket string
+	var arg_mem int
+	var arg_cpu int
+
+	resizeCmd := &cobra.Command{
+		Use:   "resize",
+		Short: "resize the cpu and memory limits of the running pod",
+		RunE: func(cmd *cobra.Command, args []string) error {
+
+			socket, err := findControlSocket(arg_socket)
+			if err != nil {
+				return err
+			}
+
+			return controlRequest(socket, "POST", fmt.Sprintf("/resize?cpu=%d&mem=%d", arg_cpu, arg_mem), nil)
+		},
+	}
+
+	resizeCmd.Flags().StringVar(&arg_socket, "socket", "", "vmm control socket (default: find it)")
+	resizeCmd.Flags().IntVar(&arg_cpu, "cpu", 0, "number of vcpus")
+	resizeCmd.Flags().IntVar(&arg_mem, "mem", 0, "guest memory in MiB")
+
+	return resizeCmd
+}
+
+func VolumeCMD() *cobra.Command {
+
+	var arg_socket string
+
+	volumeCmd := &cobra.Command{
+		Use:   "volume",
+		Short: "hotplug block volumes into the running vm",
+	}
+	volumeCmd.PersistentFlags().StringVar(&arg_socket, "socket", "", "vmm control socket (default: find it)")
+
+	var arg_device string
+
+	attachCmd := &cobra.Command{
+		Use:   "attach <name>",
+		Short: "attach a block device as volume",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+
+			socket, err := findControlSocket(arg_socket)
+			if err != nil {
+				return err
+			}
+
+			return controlRequest(socket, "POST", "/volumes/", spec.Volume{
+				Name:       args[0],
+				DevicePath: arg_device,
+			})
+		},
+	}
+	attachCmd.Flags().StringVar(&arg_device, "device-path", "", "path of the block device in this pod")
+	attachCmd.MarkFlagRequired("device-path")
+
+	detachCmd := &cobra.Command{
+		Use:   "detach <name>",
+		Short: "unmount and detach a volume",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+
+			socket, err := findControlSocket(arg_socket)
+			if err != nil {
+				return err
+			}
+
+			return controlRequest(socket, "DELETE", "/volumes/"+url.PathEscape(args[0]), nil)
+		},
+	}
+
+	volumeCmd.AddCommand(attachCmd, detachCmd)
+
+	return volumeCmd
+}
@@ -6,6 +6,7 @@ import (
 	"archive/tar"
 	"encoding/json"
 	"fmt"
+	"github.com/kraudcloud/cradle/spec"
 	"os"
 	"path/filepath"
 	"strings"
@@ -51,12 +52,52 @@ func (self *VM) PrepareCradleGuest(cradlePath string) (err error) {
 
 	self.CradleGuest.Kernel.Initrd = fmt.Sprintf("%s/%s", cradlePath, self.CradleGuest.Kernel.Initrd)
 
+	// cradle.json first, so the deployment can override
+	self.Launch.Kernel.Cmdline = append(append([]string{}, self.CradleGuest.Kernel.Cmdline...), self.Launch.Kernel.Cmdline...)
+	self.Launch.Kernel.Modules = append(append([]string{}, self.CradleGuest.Kernel.Modules...), self.Launch.Kernel.Modules...)
+
 	return nil
 }
 
+func (self *VM) kernelCmdline() string {
+	return strings.Join(append([]string{"earlyprintk=ttyS0 console=ttyS0 panic=2 printk.time=1"}, self.Launch.Kernel.Cmdline...), " ")
+}
+
 func (self *VM) MakeGuestLaunchConfig() (err error) {
 
-	js, err := json.Marshal(self.Launch)
+	// config mount content goes into the tar next to launch.json,
+	// so the launch config itself doesn't carry any secrets
+	launch := self.Launch
+	launch.Containers = make([]spec.Container, len(self.Launch.Containers))
+	copy(launch.Containers, self.Launch.Containers)
+
+	var configs = make(map[string][]byte)
+
+	for i, container := range launch.Containers {
+
+		mounts := make([]spec.ConfigMount, len(container.ConfigMounts))
+		copy(mounts, container.ConfigMounts)
+
+		for j, m := range mounts {
+
+			content := []byte(m.Content)
+			if m.HostPath != "" {
+				content, err = os.ReadFile(m.HostPath)
+				if err != nil {
+					return fmt.Errorf("config mount %s: %w", m.GuestPath, err)
+				}
+			}
+
+			configs[fmt.Sprintf("configmounts/%d/%d", i, j)] = content
+
+			mounts[j].Content = ""
+			mounts[j].HostPath = ""
+		}
+
+		launch.Containers[i].ConfigMounts = mounts
+	}
+
+	js, err := json.Marshal(launch)
 	if err != nil {
 		return err
 	}
@@ -78,5 +119,14 @@ func (self *VM) MakeGuestLaunchConfig() (err error) {
 
 	tw.Write(js)
 
+	for name, content := range configs {
+		tw.WriteHeader(&tar.Header{
+			Name: name,
+			Mode: 0600,
+			Size: int64(len(content)),
+		})
+		tw.Write(content)
+	}
+
 	return nil
 }
@@ -42,12 +42,12 @@ func (self *VM) SetupWorkDir() error {
 	writeImage := filepath.Join(self.WorkDir, "files", "cache.ext4.img")
 	wi, err := os.Create(writeImage)
 	if err != nil {
-		panic(err)
+		return err
 	}
 	defer wi.Close()
 	err = wi.Truncate(1024 * 1024 * 1024 * 10)
 	if err != nil {
-		panic(err)
+		return err
 	}
 
 	return nil
@@ -0,0 +1,189 @@
+// Copyright (c) 2020-present devguard GmbH
+
+package vmm
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/kraudcloud/cradle/spec"
+)
+
+// resolve valueFrom and $(VAR) references in container env.
+// must run after the pod network is known, since status.podIP comes from it
+func (self *VM) ResolveEnv() error {
+
+	for i := range self.Launch.Containers {
+
+		env := self.Launch.Containers[i].Process.Env
+		vars := make(map[string]string)
+
+		for k, v := range env {
+
+			if v.ValueFrom != nil {
+				value, err := self.envValueFrom(v.ValueFrom)
+				if err != nil {
+					return fmt.Errorf("container %s env %s: %w", self.Launch.Containers[i].Name, v.Name, err)
+				}
+				env[k].Value = value
+				if v.ValueFrom.File != "" {
+					env[k].Secret = true
+				}
+			} else {
+				env[k].Value = expandEnv(v.Value, vars)
+			}
+
+			vars[v.Name] = env[k].Value
+		}
+	}
+
+	return nil
+}
+
+func (self *VM) envValueFrom(from *spec.EnvValueFrom) (string, error) {
+
+	if from.PodEnv != "" {
+		return os.Getenv(from.PodEnv), nil
+	}
+
+	if from.File != "" {
+		b, err := os.ReadFile(from.File)
+		if err != nil {
+			return "", err
+		}
+		return string(b), nil
+	}
+
+	if from.FieldRef != "" {
+		return self.fieldRef(from.FieldRef)
+	}
+
+	if from.ResourceFieldRef != nil {
+		return self.resourceFieldRef(from.ResourceFieldRef)
+	}
+
+	return "", nil
+}
+
+// the vmm pod is expected to have the usual downward api env set,
+// otherwise fall back to what the pod can see about itself
+func (self *VM) fieldRef(field string) (string, error) {
+
+	switch field {
+	case "metadata.name":
+		if v := os.Getenv("POD_NAME"); v != "" {
+			return v, nil
+		}
+		return os.Hostname()
+
+	case "metadata.namespace":
+		if v := os.Getenv("POD_NAMESPACE"); v != "" {
+			return v, nil
+		}
+		b, err := os.ReadFile("/var/run/secrets/kubernetes.io/serviceaccount/namespace")
+		if err != nil {
+			return "", nil
+		}
+		return strings.TrimSpace(string(b)), nil
+
+	case "metadata.uid":
+		return os.Getenv("POD_UID"), nil
+
+	case "spec.nodeName":
+		return os.Getenv("NODE_NAME"), nil
+
+	case "status.podIP":
+		if self.PodNetwork == nil || self.PodNetwork.PodIP == nil {
+			return "", nil
+		}
+		return self.PodNetwork.PodIP.String(), nil
+	}
+
+	return "", fmt.Errorf("unsupported fieldRef %s", field)
+}
+
+// cradle has no distinction between requests and limits, both are what the vm gets
+func (self *VM) resourceFieldRef(ref *spec.ResourceFieldRef) (string, error) {
+
+	divisor := 1.0
+	if ref.Divisor != "" {
+		var err error
+		divisor, err = parseQuantity(ref.Divisor)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	var value float64
+	switch ref.Resource {
+	case "limits.cpu", "requests.cpu":
+		value = float64(self.guestCpus())
+
+	case "limits.memory", "requests.memory":
+		value = float64(self.guestMemory()) * 1024 * 1024
+
+	default:
+		return "", fmt.Errorf("unsupported resourceFieldRef %s", ref.Resource)
+	}
+
+	return strconv.FormatInt(int64(math.Ceil(value/divisor)), 10), nil
+}
+
+// k8s resource quantity like 1m, 1k or 1Mi
+func parseQuantity(q string) (float64, error) {
+
+	suffixes := []struct {
+		suffix string
+		factor float64
+	}{
+		{"Ki", 1 << 10}, {"Mi", 1 << 20}, {"Gi", 1 << 30}, {"Ti", 1 << 40}, {"Pi", 1 << 50}, {"Ei", 1 << 60},
+		{"m", 1e-3}, {"k", 1e3}, {"M", 1e6}, {"G", 1e9}, {"T", 1e12}, {"P", 1e15}, {"E", 1e18},
+	}
+
+	factor := 1.0
+	for _, s := range suffixes {
+		if strings.HasSuffix(q, s.suffix) {
+			q = strings.TrimSuffix(q, s.suffix)
+			factor = s.factor
+			break
+		}
+	}
+
+	f, err := strconv.ParseFloat(q, 64)
+	if err != nil || f <= 0 {
+		return 0, fmt.Errorf("invalid quantity %s", q)
+	}
+
+	return f * factor, nil
+}
+
+var envRefRegexp = regexp.MustCompile(`\$\$|\$\(([A-Za-z_][A-Za-z0-9_.-]*)\)`)
+
+// expand $(VAR) like k8s does: only previously defined vars, $$ escapes, unknown refs stay as they are
+func expandEnv(s string, vars map[string]string) string {
+	return envRefRegexp.ReplaceAllStringFunc(s, func(ref string) string {
+		if ref == "$$" {
+			return "$"
+		}
+		if v, ok := vars[ref[2:len(ref)-1]]; ok {
+			return v
+		}
+		return ref
+	})
+}
+
+// replace secret env values in s before it leaves the vmm
+func (self *VM) redact(s string) string {
+	for _, container := range self.Launch.Containers {
+		for _, v := range container.Process.Env {
+			if v.Secret && len(v.Value) > 3 {
+				s = strings.ReplaceAll(s, v.Value, "<redacted>")
+			}
+		}
+	}
+	return s
+}
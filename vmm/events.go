@@ -0,0 +1,121 @@
+// Copyright (c) 2020-present devguard GmbH
+
+package vmm
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/kraudcloud/cradle/spec"
+)
+
+func (self *VM) readyFilePath() string {
+	if self.ReadyFile != "" {
+		return self.ReadyFile
+	}
+	return filepath.Join(self.WorkDir, "ready")
+}
+
+// follow boot stages and container state changes pushed by guest init.
+// once qemu exited, the end of a stream means we got every event there is
+func (self *VM) StreamEvents(ctx context.Context) {
+
+	var since uint64
+
+	for {
+		err := self.streamEvents(ctx, &since)
+		if err != nil {
+			log.Debugf("guest events: %v", err)
+		}
+
+		select {
+		case <-self.exited:
+			close(self.eventsDone)
+			return
+		default:
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+func (self *VM) streamEvents(ctx context.Context, since *uint64) error {
+
+	req, err := http.NewRequestWithContext(ctx, "GET",
+		fmt.Sprintf("http://cradle/v1.41/vmm/events?since=%d", *since), nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := self.guestClient(0).Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s", resp.Status)
+	}
+
+	dec := json.NewDecoder(resp.Body)
+	for {
+		var e spec.Event
+		err := dec.Decode(&e)
+		if err != nil {
+			return err
+		}
+
+		*since = e.Seq
+		self.handleEvent(e)
+	}
+}
+
+func (self *VM) handleEvent(e spec.Event) {
+
+	switch e.Type {
+	case spec.EVENT_STAGE:
+		log.Infof("guest stage: %s", e.Stage)
+
+	case spec.EVENT_CONTAINER:
+		if e.Reason != "" {
+			log.Infof("container %s %s (code %d): %s", e.Container, e.State, e.ExitCode, e.Reason)
+		} else {
+			log.Infof("container %s %s", e.Container, e.State)
+		}
+
+	case spec.EVENT_SHUTDOWN:
+		log.Warnf("guest shutting down: %s", e.Reason)
+		self.exit.setGuest(e)
+
+	default:
+		log.Debugf("unknown guest event %q", e.Type)
+	}
+
+	self.Stage.Store(uint32(e.Stage))
+	self.updateReady()
+}
+
+// k8s readiness, for an exec probe like "test -f <ready file>".
+// every container and health change comes with an event, so this stays current
+func (self *VM) updateReady() {
+
+	if spec.Stage(self.Stage.Load()) == spec.STAGE_POD_UP && self.probeReady() == nil {
+		f, err := os.Create(self.readyFilePath())
+		if err != nil {
+			log.Warnf("ready file: %v", err)
+			return
+		}
+		f.Close()
+	} else {
+		os.Remove(self.readyFilePath())
+	}
+}
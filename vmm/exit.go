@@ -0,0 +1,196 @@
+// Copyright (c) 2020-present devguard GmbH
+
+package vmm
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/kraudcloud/cradle/spec"
+	"os"
+	"sync"
+	"time"
+)
+
+// why the vm stopped, as far as the vmm can tell
+type ExitReason string
+
+const (
+	ExitUnknown       ExitReason = "unknown"
+	ExitGuestShutdown ExitReason = "guest shutdown"
+	ExitGuestReset    ExitReason = "guest reset"
+	ExitGuestPanic    ExitReason = "guest panic"
+	ExitWatchdog      ExitReason = "watchdog"
+	ExitHostShutdown  ExitReason = "host shutdown"
+	ExitQemuCrash     ExitReason = "qemu crashed"
+	ExitUnresponsive  ExitReason = "guest unresponsive"
+	ExitGuestOOM      ExitReason = "guest out of memory"
+)
+
+type vmExit struct {
+	lock   sync.Mutex
+	reason ExitReason
+	detail string
+
+	// shutdown event from guest init, if it got out before the guest powered off
+	guest *spec.Event
+
+	// last oom kill the guest kernel reported
+	oom     string
+	oomTime time.Time
+}
+
+// exit code of the vmm when the vm stopped for this reason.
+// a critical container exiting makes the vmm exit with the containers code instead
+func (reason ExitReason) exitCode() int {
+	switch reason {
+	case ExitHostShutdown:
+		return 0
+	case ExitGuestPanic:
+		return 3
+	case ExitWatchdog:
+		return 4
+	case ExitQemuCrash:
+		return 5
+	case ExitUnresponsive:
+		return 6
+	case ExitGuestOOM:
+		return 7
+	}
+	return 1
+}
+
+// panic, watchdog and missed heartbeats are the root cause of the reset or shutdown that follows,
+// and a host requested shutdown explains the guest powering off.
+// the first reason of a rank above zero wins
+func (reason ExitReason) rank() int {
+	switch reason {
+	case ExitGuestPanic, ExitWatchdog, ExitUnresponsive:
+		return 2
+	case ExitHostShutdown:
+		return 1
+	}
+	return 0
+}
+
+func (self *vmExit) set(reason ExitReason, detail string) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	if self.reason.rank() > reason.rank() {
+		return
+	}
+	if self.reason.rank() > 0 && self.reason.rank() == reason.rank() {
+		return
+	}
+
+	self.reason = reason
+	self.detail = detail
+}
+
+func (self *vmExit) setGuest(e spec.Event) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	self.guest = &e
+}
+
+// exit code and k8s termination message for the vm having stopped for reason
+func (self *vmExit) status(reason ExitReason, detail string) (int, string) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	code := reason.exitCode()
+
+	msg := string(reason)
+	if detail != "" {
+		msg += ": " + detail
+	}
+
+	// the guest knows better why it powered off, unless we asked it to
+	// or the kernel had a more fundamental problem
+	if self.guest != nil && reason.rank() == 0 && reason != ExitGuestOOM && reason != ExitQemuCrash {
+		msg = self.guest.Reason
+		if self.guest.Container != "" {
+			code = self.guest.ExitCode
+			if self.guest.Output != "" {
+				msg += "\n\n" + self.guest.Output
+			}
+		}
+	}
+
+	return code, msg
+}
+
+// k8s shows this in kubectl describe, and truncates it at 4096 bytes anyway
+func writeTerminationMessage(path string, msg string) {
+
+	if path == "" {
+		return
+	}
+
+	if len(msg) > 4096 {
+		msg = msg[len(msg)-4096:]
+	}
+
+	err := os.WriteFile(path, []byte(msg), 0644)
+	if err != nil {
+		log.Warnf("termination message: %v", err)
+	}
+}
+
+func (self *vmExit) oomKill(msg string) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	self.oom = msg
+	self.oomTime = time.Now()
+}
+
+func (self *vmExit) get() (ExitReason, string) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	// an oom kill right before the guest went down, without a more specific reason, is why it did
+	if self.reason.rank() == 0 && self.oom != "" && time.Since(self.oomTime) < 30*time.Second {
+		return ExitGuestOOM, self.oom
+	}
+
+	if self.reason == "" {
+		return ExitUnknown, ""
+	}
+	return self.reason, self.detail
+}
+
+func (self *VM) watchQMPEvents(events <-chan QMPEvent) {
+
+	for ev := range events {
+		switch ev.Event {
+
+		case "SHUTDOWN":
+			var data struct {
+				Guest  bool   `json:"guest"`
+				Reason string `json:"reason"`
+			}
+			json.Unmarshal(ev.Data, &data)
+
+			switch data.Reason {
+			case "guest-shutdown":
+				self.exit.set(ExitGuestShutdown, data.Reason)
+			case "guest-reset", "guest-s3", "guest-panic":
+				self.exit.set(ExitGuestReset, data.Reason)
+			default:
+				self.exit.set(ExitHostShutdown, data.Reason)
+			}
+
+		case "GUEST_PANICKED", "GUEST_CRASHLOADED":
+			self.exit.set(ExitGuestPanic, string(ev.Data))
+
+		case "WATCHDOG":
+			var data struct {
+				Action string `json:"action"`
+			}
+			json.Unmarshal(ev.Data, &data)
+			self.exit.set(ExitWatchdog, fmt.Sprintf("watchdog fired, action %s", data.Action))
+		}
+	}
+}
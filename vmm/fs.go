@@ -3,19 +3,131 @@
 package vmm
 
 import (
+	"fmt"
 	"os"
+	"os/exec"
 	"path/filepath"
+	"syscall"
+	"time"
 )
 
+func (self *VM) fsSocketPath(i int) string {
+	return filepath.Join(self.WorkDir, "fs", fmt.Sprintf("%d.sock", i))
+}
+
+// start one virtiofsd per virtiofs volume. the guest mounts them by tag fs<index>
 func (self *VM) StartFilesystems() error {
 
+	// fail before spawning anything qemu can't take anyway
+	err := self.checkVirtioSlots()
+	if err != nil {
+		return err
+	}
+
 	os.MkdirAll(filepath.Join(self.WorkDir, "fs"), 0755)
+
+	for i, volume := range self.Launch.Volumes {
+
+		if volume.Transport != "virtiofs" && volume.Transport != "9p" {
+			continue
+		}
+
+		if volume.HostPath == "" {
+			return fmt.Errorf("volume %s: transport %s requires hostPath", volume.Name, volume.Transport)
+		}
+
+		if _, err := os.Stat(volume.HostPath); err != nil {
+			return fmt.Errorf("volume %s: %w", volume.Name, err)
+		}
+
+		// 9p is served by qemu itself
+		if volume.Transport != "virtiofs" {
+			continue
+		}
+
+		socket := self.fsSocketPath(i)
+		os.Remove(socket)
+
+		cmd := exec.Command(virtiofsdPath(),
+			"--socket-path", socket,
+			"--shared-dir", volume.HostPath,
+			"--cache", "auto",
+			"--announce-submounts",
+		)
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		cmd.SysProcAttr = &syscall.SysProcAttr{
+			Pdeathsig: syscall.SIGKILL,
+		}
+
+		err := cmd.Start()
+		if err != nil {
+			return fmt.Errorf("virtiofsd for volume %s: %w", volume.Name, err)
+		}
+
+		self.Filesystems = append(self.Filesystems, cmd)
+
+		go self.superviseFilesystem(volume.Name, cmd)
+
+		// qemu fails to start if the socket isn't there yet
+		err = waitForSocket(socket, 10*time.Second)
+		if err != nil {
+			return fmt.Errorf("virtiofsd for volume %s: %w", volume.Name, err)
+		}
+	}
+
 	return nil
 }
 
+// qemu can't reconnect to a restarted virtiofsd, so a dead one means the volume is gone.
+// stop the vm instead of letting containers run on top of a broken mount
+func (self *VM) superviseFilesystem(name string, cmd *exec.Cmd) {
+
+	err := cmd.Wait()
+
+	if self.fsStopping.Load() {
+		return
+	}
+
+	log.Errorf("virtiofsd for volume %s exited: %v", name, err)
+
+	// before qemu runs, qemu failing to connect stops the launch anyway
+	select {
+	case <-self.launched:
+	default:
+		return
+	}
+
+	self.Shutdown(fmt.Sprintf("virtiofsd for volume %s exited", name), 30*time.Second)
+}
+
 func (self *VM) KillFilesystems() {
 
+	self.fsStopping.Store(true)
+
 	for _, fs := range self.Filesystems {
 		fs.Process.Kill()
 	}
 }
+
+// alpine installs virtiofsd outside of PATH
+func virtiofsdPath() string {
+	if p, err := exec.LookPath("virtiofsd"); err == nil {
+		return p
+	}
+	return "/usr/libexec/virtiofsd"
+}
+
+func waitForSocket(path string, timeout time.Duration) error {
+
+	deadline := time.Now().Add(timeout)
+	for {
+		if _, err := os.Stat(path); err == nil {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("timeout waiting for %s", path)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
@@ -0,0 +1,116 @@
+// Copyright (c) 2020-present devguard GmbH
+
+package vmm
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/kraudcloud/cradle/spec"
+	"github.com/mdlayher/vsock"
+)
+
+// http client for the vdocker api of the guest
+func (self *VM) guestClient(timeout time.Duration) *http.Client {
+	return &http.Client{
+		Timeout: timeout,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				return vsock.Dial(self.PodNetwork.CID, 1, &vsock.Config{})
+			},
+			DisableKeepAlives: true,
+		},
+	}
+}
+
+// ask the guest init to stop all containers and power off
+func (self *VM) guestShutdown(reason string) error {
+
+	resp, err := self.guestClient(5*time.Second).Post(
+		"http://cradle/v1.41/vmm/shutdown?reason="+url.QueryEscape(reason), "", nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("guest shutdown: %s", resp.Status)
+	}
+
+	return nil
+}
+
+// have the guest mount a hotplugged volume. formatting a new one takes a while
+func (self *VM) guestAttachVolume(volume spec.Volume) error {
+
+	js, err := json.Marshal(volume)
+	if err != nil {
+		return err
+	}
+
+	resp, err := self.guestClient(2*time.Minute).Post(
+		"http://cradle/v1.41/vmm/volumes", "application/json", bytes.NewReader(js))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("guest attach volume %s: %s %s", volume.Name, resp.Status, string(body))
+	}
+
+	return nil
+}
+
+// limit the containers in the guest to the pod size. zero leaves a resource alone
+func (self *VM) guestResources(resources spec.Resources) error {
+
+	js, err := json.Marshal(resources)
+	if err != nil {
+		return err
+	}
+
+	resp, err := self.guestClient(10*time.Second).Post(
+		"http://cradle/v1.41/vmm/resources", "application/json", bytes.NewReader(js))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("guest resources: %s %s", resp.Status, string(body))
+	}
+
+	return nil
+}
+
+// have the guest unmount a volume so its device can be unplugged
+func (self *VM) guestDetachVolume(name string) error {
+
+	req, err := http.NewRequest("DELETE", "http://cradle/v1.41/vmm/volumes/"+url.PathEscape(name), nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := self.guestClient(60 * time.Second).Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("guest detach volume %s: %s %s", name, resp.Status, string(body))
+	}
+
+	return nil
+}
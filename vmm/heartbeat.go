@@ -0,0 +1,126 @@
+// Copyright (c) 2020-present devguard GmbH
+
+package vmm
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// what guest init reports on every beat
+type heartbeat struct {
+	Uptime         float64
+	Load           []float64
+	Memory         map[string]uint64
+	MemoryPressure map[string]float64
+}
+
+func (self heartbeat) String() string {
+	return fmt.Sprintf("uptime %.0fs load %v mem available %d/%d pressure %v",
+		self.Uptime, self.Load, self.Memory["Available"], self.Memory["Total"], self.MemoryPressure)
+}
+
+func (self *VM) beat() (*heartbeat, error) {
+
+	resp, err := self.guestClient(self.HeartbeatInterval).Get("http://cradle/v1.41/vmm/heartbeat")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("heartbeat: %s", resp.Status)
+	}
+
+	var hb heartbeat
+	err = json.NewDecoder(resp.Body).Decode(&hb)
+	if err != nil {
+		return nil, err
+	}
+
+	return &hb, nil
+}
+
+// poll guest init and shut the vm down once it missed HeartbeatMisses beats in a row.
+// beats only count once the guest answered the first one, boot is up to the startup probe
+func (self *VM) Heartbeat(ctx context.Context) {
+
+	if self.HeartbeatMisses <= 0 || self.HeartbeatInterval <= 0 {
+		return
+	}
+
+	var last *heartbeat
+	var lastTime time.Time
+	missed := 0
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-self.exited:
+			return
+		case <-time.After(self.HeartbeatInterval):
+		}
+
+		hb, err := self.beat()
+		if err == nil {
+			if missed > 0 {
+				log.Warnf("guest heartbeat back after %d missed", missed)
+			}
+			last, lastTime, missed = hb, time.Now(), 0
+			log.Debugf("guest heartbeat: %s", hb)
+			continue
+		}
+
+		if last == nil {
+			continue
+		}
+
+		missed++
+		log.Warnf("guest missed heartbeat %d/%d: %v", missed, self.HeartbeatMisses, err)
+
+		if missed < self.HeartbeatMisses {
+			continue
+		}
+
+		detail := fmt.Sprintf("no heartbeat for %s, last: %s", time.Since(lastTime).Round(time.Second), last)
+		status := self.captureHang(detail)
+		self.exit.set(ExitUnresponsive, detail+", qemu status: "+status)
+		self.Shutdown("guest unresponsive", 10*time.Second)
+		return
+	}
+}
+
+// log what we know about a guest that stopped answering, before we kill it.
+// returns the qemu run state
+func (self *VM) captureHang(detail string) string {
+
+	log.Errorf("guest unresponsive: %s", detail)
+
+	status := "unknown"
+	if self.QMP != nil {
+		ch := make(chan string, 1)
+		go func() {
+			s, err := self.QMP.QueryStatus()
+			if err != nil {
+				s = err.Error()
+			}
+			ch <- s
+		}()
+		select {
+		case status = <-ch:
+		case <-time.After(5 * time.Second):
+			status = "qmp not responding"
+		}
+	}
+	log.Errorf("qemu status: %s", status)
+
+	tail := self.serial.Tail(50)
+	log.Errorf("last %d lines of serial console:\n%s", len(tail), strings.Join(tail, "\n"))
+
+	return status
+}
@@ -7,6 +7,7 @@ import (
 	"crypto/sha256"
 	"github.com/kraudcloud/cradle/spec"
 	"strings"
+	"time"
 
 	"fmt"
 	"io"
@@ -19,6 +20,45 @@ import (
 	"github.com/google/go-containerregistry/pkg/v1/remote"
 )
 
+// download the images of all containers and fill in what the launch spec leaves to the image
+func (self *VM) DownloadImages(ctx context.Context) error {
+
+	log.Println("downloading images")
+	start := time.Now()
+
+	for i := range self.Launch.Containers {
+
+		ctr2, err := self.DownloadImage(ctx, self.Launch.Containers[i].Image.Ref, "")
+		if err != nil {
+			return err
+		}
+		self.Launch.Containers[i].Image = ctr2.Image
+
+		if self.Launch.Containers[i].Process.Cmd == nil {
+			self.Launch.Containers[i].Process.Cmd = ctr2.Process.Cmd
+		}
+		if self.Launch.Containers[i].Process.Workdir == "" {
+			self.Launch.Containers[i].Process.Workdir = ctr2.Process.Workdir
+		}
+
+		if self.Launch.Containers[i].Name == "" {
+			self.Launch.Containers[i].Name = ctr2.Name
+		}
+		if self.Launch.Containers[i].Name == "" {
+			self.Launch.Containers[i].Name = fmt.Sprintf("container.%d", i)
+		}
+
+		self.Launch.Containers[i].Process.Env = append(
+			ctr2.Process.Env,
+			self.Launch.Containers[i].Process.Env...,
+		)
+	}
+
+	self.recordPhase("image_download", start)
+
+	return nil
+}
+
 func (self *VM) DownloadImage(
 	ctx context.Context,
 	strref string,
@@ -74,10 +114,14 @@ func (self *VM) DownloadImage(
 
 		h := sha256.New()
 
-		_, err = io.Copy(lo, io.TeeReader(readTar, h))
+		start := time.Now()
+		n, err := io.Copy(lo, io.TeeReader(readTar, h))
+		lo.Close()
+		readTar.Close()
 		if err != nil {
 			return nil, fmt.Errorf("cannot download layer %s: %w", diffID, err)
 		}
+		self.recordLayer(n, start)
 
 		specLayers = append(specLayers, spec.Layer{
 			ID:     fmt.Sprintf("%d", self.layerCount),
@@ -0,0 +1,330 @@
+// Copyright (c) 2020-present devguard GmbH
+
+package vmm
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// the vmm goes through these in order. a failure in any of them tears down
+// everything the previous ones set up, in reverse order
+type Phase string
+
+const (
+	PhaseConfig       Phase = "config"
+	PhaseWorkDir      Phase = "workdir"
+	PhaseMetrics      Phase = "metrics"
+	PhaseImages       Phase = "images"
+	PhaseNetwork      Phase = "network"
+	PhaseEnv          Phase = "env"
+	PhaseCradle       Phase = "cradle"
+	PhaseLaunchConfig Phase = "launch config"
+	PhaseFilesystems  Phase = "filesystems"
+	PhaseQemu         Phase = "qemu"
+	PhaseQMP          Phase = "qmp"
+	PhaseControl      Phase = "control"
+	PhaseNetworkPost  Phase = "network post launch"
+	PhaseVDocker      Phase = "vdocker"
+	PhaseRunning      Phase = "running"
+)
+
+// exit codes of failed startup phases. the ones of a vm that started are in exit.go
+var phaseExitCodes = map[Phase]int{
+	PhaseConfig:       10,
+	PhaseWorkDir:      11,
+	PhaseMetrics:      12,
+	PhaseImages:       13,
+	PhaseNetwork:      14,
+	PhaseEnv:          15,
+	PhaseCradle:       16,
+	PhaseLaunchConfig: 17,
+	PhaseFilesystems:  18,
+	PhaseQemu:         19,
+	PhaseQMP:          20,
+	PhaseControl:      21,
+	PhaseNetworkPost:  22,
+	PhaseVDocker:      23,
+}
+
+type PhaseError struct {
+	Phase Phase
+	Err   error
+}
+
+func (e *PhaseError) Error() string {
+	return fmt.Sprintf("%s: %v", e.Phase, e.Err)
+}
+
+func (e *PhaseError) Unwrap() error {
+	return e.Err
+}
+
+func (e *PhaseError) ExitCode() int {
+	if code, ok := phaseExitCodes[e.Phase]; ok {
+		return code
+	}
+	return 1
+}
+
+type lifecycle struct {
+	ctx   context.Context
+	phase Phase
+
+	// undo functions of the phases entered so far
+	teardown []func()
+}
+
+// enter phase and run fn. undo is registered before fn runs, so it must cope
+// with fn having failed half way. panics are reported as errors of the phase
+func (self *lifecycle) step(phase Phase, fn func() error, undo func()) (err error) {
+
+	if self.ctx.Err() != nil {
+		return &PhaseError{Phase: phase, Err: fmt.Errorf("cancelled")}
+	}
+
+	self.phase = phase
+	log.Printf("phase: %s", phase)
+
+	if undo != nil {
+		self.teardown = append(self.teardown, undo)
+	}
+
+	defer func() {
+		if r := recover(); r != nil {
+			err = &PhaseError{Phase: phase, Err: fmt.Errorf("panic: %v", r)}
+		}
+	}()
+
+	err = fn()
+	if err != nil {
+		return &PhaseError{Phase: phase, Err: err}
+	}
+
+	return nil
+}
+
+func (self *lifecycle) Teardown() {
+
+	log.Printf("teardown from phase %s", self.phase)
+
+	for i := len(self.teardown) - 1; i >= 0; i-- {
+		func() {
+			defer func() {
+				if r := recover(); r != nil {
+					log.Errorf("teardown: panic: %v", r)
+				}
+			}()
+			self.teardown[i]()
+		}()
+	}
+	self.teardown = nil
+
+	log.Info("teardown complete")
+}
+
+type RunOptions struct {
+	Cradle         string
+	MetricsAddr    string
+	ProbeAddr      string
+	TerminationLog string
+}
+
+// run the vm until it exits and return the exit code for the vmm
+func (self *VM) Run(ctx context.Context, opts RunOptions) int {
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	lc := &lifecycle{ctx: ctx}
+
+	// virtiofsd supervision waits on these before qemu even starts
+	self.launched = make(chan struct{})
+	self.exited = make(chan struct{})
+	self.eventsDone = make(chan struct{})
+
+	// a signal before the vm runs aborts startup at the next phase,
+	// afterwards it shuts the guest down gracefully
+	sigc := make(chan os.Signal, 1)
+	signal.Notify(sigc, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
+	defer signal.Stop(sigc)
+
+	// whether startup completed is decided under runningLock,
+	// so a signal is either handled as abort or as shutdown, never lost in between
+	running := make(chan struct{})
+	var runningLock sync.Mutex
+
+	go func() {
+		var sig os.Signal
+		select {
+		case sig = <-sigc:
+		case <-ctx.Done():
+			return
+		}
+
+		go func() {
+			<-sigc
+			os.Exit(1)
+		}()
+
+		runningLock.Lock()
+		select {
+		case <-running:
+			runningLock.Unlock()
+			log.Printf("received %s, shutting down vm", sig)
+			self.Shutdown(fmt.Sprintf("vmm received %s", sig), 30*time.Second)
+		default:
+			log.Printf("received %s, aborting startup", sig)
+			cancel()
+			runningLock.Unlock()
+		}
+	}()
+
+	err := self.start(ctx, lc, opts)
+	if err != nil {
+		log.Errorf("startup failed: %v", err)
+		lc.Teardown()
+
+		code := 1
+		if perr, ok := err.(*PhaseError); ok {
+			code = perr.ExitCode()
+		}
+		writeTerminationMessage(opts.TerminationLog, self.redact(err.Error()))
+		return code
+	}
+
+	runningLock.Lock()
+	lc.phase = PhaseRunning
+	close(running)
+	aborted := ctx.Err() != nil
+	runningLock.Unlock()
+
+	// startup was aborted after its last phase, the vm is up and has to go down
+	if aborted {
+		go self.Shutdown("vmm startup aborted", 30*time.Second)
+	}
+
+	log.Println("vm up")
+	reason, err := self.Wait()
+	if err == nil {
+		log.Errorf("VM EXIT (%s, code %d) ", reason, self.Cmd.ProcessState.ExitCode())
+	} else {
+		log.Errorf("VM EXIT (%s, err %s) ", reason, err)
+	}
+
+	_, detail := self.exit.get()
+	code, msg := self.exit.status(reason, detail)
+
+	// the kernel log leading up to it is the most useful thing we can add
+	if reason == ExitGuestPanic || reason == ExitGuestOOM {
+		msg += "\n\n" + strings.Join(self.serial.Tail(30), "\n")
+	}
+	log.Printf("exit code %d: %s", code, msg)
+	writeTerminationMessage(opts.TerminationLog, self.redact(msg))
+
+	lc.Teardown()
+
+	return code
+}
+
+func (self *VM) start(ctx context.Context, lc *lifecycle, opts RunOptions) error {
+
+	err := lc.step(PhaseWorkDir, self.SetupWorkDir, func() {
+		os.Remove(self.readyFilePath())
+		self.Cleanup()
+	})
+	if err != nil {
+		return err
+	}
+
+	// metrics cover the whole startup, so they come up first.
+	// probes only bind here, the guest backed ones are served once qemu runs
+	err = lc.step(PhaseMetrics, func() error {
+		err := self.StartMetrics(opts.MetricsAddr)
+		if err != nil {
+			return err
+		}
+		return self.StartProbes(opts.ProbeAddr)
+	}, nil)
+	if err != nil {
+		return err
+	}
+
+	err = lc.step(PhaseImages, func() error { return self.DownloadImages(ctx) }, nil)
+	if err != nil {
+		return err
+	}
+
+	start := time.Now()
+	err = lc.step(PhaseNetwork, self.StartNetwork, self.StopNetwork)
+	if err != nil {
+		return err
+	}
+	self.recordPhase("network_setup", start)
+
+	err = lc.step(PhaseEnv, self.ResolveEnv, nil)
+	if err != nil {
+		return err
+	}
+
+	err = lc.step(PhaseCradle, func() error { return self.PrepareCradleGuest(opts.Cradle) }, nil)
+	if err != nil {
+		return err
+	}
+
+	err = lc.step(PhaseLaunchConfig, self.MakeGuestLaunchConfig, nil)
+	if err != nil {
+		return err
+	}
+
+	err = lc.step(PhaseFilesystems, self.StartFilesystems, self.KillFilesystems)
+	if err != nil {
+		return err
+	}
+
+	start = time.Now()
+	err = lc.step(PhaseQemu, self.LaunchQemu, self.KillQemu)
+	if err != nil {
+		return err
+	}
+	self.recordPhase("qemu_start", start)
+	self.ServeProbes()
+
+	err = lc.step(PhaseQMP, self.ConnectQMP, nil)
+	if err != nil {
+		return err
+	}
+
+	go self.WatchResources(ctx)
+	go self.WatchHang(ctx)
+	go self.WaitGuestUp(ctx, start)
+
+	err = lc.step(PhaseControl, self.StartControl, func() {
+		os.Remove(self.controlSocketPath())
+	})
+	if err != nil {
+		return err
+	}
+
+	err = lc.step(PhaseNetworkPost, self.SetupNetworkPostLaunch, nil)
+	if err != nil {
+		return err
+	}
+
+	err = lc.step(PhaseVDocker, self.StartVDocker, nil)
+	if err != nil {
+		return err
+	}
+
+	go self.StreamLogs(ctx)
+	go self.StreamEvents(ctx)
+	go self.Heartbeat(ctx)
+
+	return nil
+}
@@ -0,0 +1,83 @@
+// Copyright (c) 2020-present devguard GmbH
+
+package vmm
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// one line of container output, as streamed by the guest
+type guestLogLine struct {
+	Seq       uint64    `json:"seq"`
+	Container string    `json:"container"`
+	Stream    string    `json:"stream"`
+	Time      time.Time `json:"time"`
+	Log       string    `json:"log"`
+}
+
+// follow the output of all containers and write it to our own stdout and stderr,
+// so it shows up in kubectl logs and whatever collects logs from the node
+func (self *VM) StreamLogs(ctx context.Context) {
+
+	var after uint64
+
+	for {
+		err := self.streamLogs(ctx, &after)
+		if err != nil {
+			log.Debugf("container logs: %v", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+// after is updated as lines come in, so a reconnect continues where we left off
+func (self *VM) streamLogs(ctx context.Context, after *uint64) error {
+
+	req, err := http.NewRequestWithContext(ctx, "GET", fmt.Sprintf("http://cradle/v1.41/vmm/logs?after=%d", *after), nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := self.guestClient(0).Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s", resp.Status)
+	}
+
+	dec := json.NewDecoder(resp.Body)
+	for {
+		var line guestLogLine
+		err := dec.Decode(&line)
+		if err != nil {
+			return err
+		}
+
+		*after = line.Seq
+
+		out := os.Stdout
+		if line.Stream == "stderr" {
+			out = os.Stderr
+		}
+
+		fmt.Fprintf(out, "%s [%s] %s\n",
+			line.Time.UTC().Format(time.RFC3339Nano),
+			line.Container,
+			strings.TrimRight(line.Log, "\r\n"),
+		)
+	}
+}
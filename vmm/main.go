@@ -9,11 +9,11 @@ import (
 	"github.com/spf13/cobra"
 	"gopkg.in/yaml.v3"
 	"net"
+	"net/http"
 	"os"
 	"os/exec"
-	"os/signal"
+	"sync"
 	"sync/atomic"
-	"syscall"
 	"time"
 )
 
@@ -28,10 +28,21 @@ type VM struct {
 	CradleGuest spec.Cradle
 
 	// qemu
-	Cmd *exec.Cmd
+	Cmd    *exec.Cmd
+	QMP    *QMP
+	exit   vmExit
+	serial serialLog
+
+	// closed once qemu runs, and once it exited
+	launched chan struct{}
+	exited   chan struct{}
+
+	// closed once the guest event stream ended after qemu exited
+	eventsDone chan struct{}
 
 	// virtiofsd
 	Filesystems []*exec.Cmd
+	fsStopping  atomic.Bool
 
 	// sdn
 	EthHostSideMac  [6]byte
@@ -41,10 +52,27 @@ type VM struct {
 	Gw4             net.IP
 	Gw6             net.IP
 
-	// reporter keepalive
+	// guest boot stage (spec.Stage), as pushed by guest events
 	Stage atomic.Uint32
 
+	// touched while the guest is up, for k8s readiness
+	ReadyFile string
+
+	// k8s http probes, answered as starting until qemu runs
+	probes atomic.Pointer[http.ServeMux]
+
+	// guest init liveness. 0 misses disables supervision
+	HeartbeatInterval time.Duration
+	HeartbeatMisses   int
+
+	// runtime resize and volume hotplug
+	volumesLock sync.Mutex
+	hotVolumes  map[string]bool
+	resizeLock  sync.Mutex
+
 	PodNetwork *PodNetwork
+
+	metrics vmMetrics
 }
 
 var log = logrus.WithField("prefix", "vmm")
@@ -55,20 +83,25 @@ func RunCMD() *cobra.Command {
 	var arg_instance uint16
 	var arg_spec string
 
-	var arg_mem int
-	var arg_cpu int
+	var arg_metrics string
+	var arg_ready string
+	var arg_probes string
+	var arg_termination string
+	var arg_hb_interval time.Duration
+	var arg_hb_misses int
 
 	runCmd := &cobra.Command{
 		Use:   "run [command]",
 		Short: "run",
 		Run: func(cmd *cobra.Command, args []string) {
 
-			defer log.Info("teardown complete")
-
 			cro := spec.CradleLaunchIntent{}
 			err := yaml.Unmarshal([]byte(arg_spec), &cro)
 			if err != nil {
-				panic(err)
+				err = &PhaseError{Phase: PhaseConfig, Err: err}
+				log.Error(err)
+				writeTerminationMessage(arg_termination, err.Error())
+				os.Exit(err.(*PhaseError).ExitCode())
 			}
 
 			vm := &VM{
@@ -77,130 +110,26 @@ func RunCMD() *cobra.Command {
 					ID:         cro.Spec.ID,
 					Containers: cro.Spec.Containers,
 					Resources:  cro.Spec.Resources,
-					Volumes:	cro.Spec.VolumeDevices,
+					Volumes:    append(cro.Spec.VolumeDevices, cro.Spec.Volumes...),
+					Kernel:     cro.Spec.Kernel,
+					Sysctls:    cro.Spec.Sysctls,
+					LogExport:  cro.Spec.LogExport,
 				},
-				WorkDir: fmt.Sprintf("/var/run/cradle/pods/%s/%d", cro.Spec.ID, arg_instance),
-			}
+				WorkDir:   fmt.Sprintf("/var/run/cradle/pods/%s/%d", cro.Spec.ID, arg_instance),
+				ReadyFile: arg_ready,
 
-			err = vm.SetupWorkDir()
-			if err != nil {
-				//TODO panics are not reported as vm log yet
-				panic(err)
-			}
-			defer vm.Cleanup()
-
-			vm.Launch.Resources.Cpu = arg_cpu
-			vm.Launch.Resources.Mem = arg_mem
-
-			log.Println("downloading images")
-			for i := range vm.Launch.Containers {
-
-				ctr2, err := vm.DownloadImage(cmd.Context(), vm.Launch.Containers[i].Image.Ref, "")
-				if err != nil {
-					panic(err)
-				}
-				vm.Launch.Containers[i].Image = ctr2.Image
-
-				if vm.Launch.Containers[i].Process.Cmd == nil {
-					vm.Launch.Containers[i].Process.Cmd = ctr2.Process.Cmd
-				}
-				if vm.Launch.Containers[i].Process.Workdir == "" {
-					vm.Launch.Containers[i].Process.Workdir = ctr2.Process.Workdir
-				}
-
-				if vm.Launch.Containers[i].Name == "" {
-					vm.Launch.Containers[i].Name = ctr2.Name
-				}
-				if vm.Launch.Containers[i].Name == "" {
-					vm.Launch.Containers[i].Name = fmt.Sprintf("container.%d", i)
-				}
-
-				vm.Launch.Containers[i].Process.Env = append(
-					ctr2.Process.Env,
-					vm.Launch.Containers[i].Process.Env...,
-				)
-
-				for k, v := range vm.Launch.Containers[i].Process.Env {
-					if v.ValueFrom != nil {
-						if v.ValueFrom.PodEnv != "" {
-							vm.Launch.Containers[i].Process.Env[k].Value = os.Getenv(v.ValueFrom.PodEnv)
-						}
-					}
-				}
+				HeartbeatInterval: arg_hb_interval,
+				HeartbeatMisses:   arg_hb_misses,
 			}
 
-			log.Println("setting up pod network")
-			err = vm.StartNetwork()
-			if err != nil {
-				panic(err)
-			}
-			defer vm.StopNetwork()
-
-			log.Println("prepare cradle")
-			err = vm.PrepareCradleGuest(arg_cradle)
-			if err != nil {
-				panic(err)
-			}
-
-			log.Println("make launch guest config")
-			err = vm.MakeGuestLaunchConfig()
-			if err != nil {
-				panic(err)
-			}
-
-			log.Println("start filesystem")
-			err = vm.StartFilesystems()
-			if err != nil {
-				panic(err)
-			}
-			defer vm.KillFilesystems()
-
-			log.Println("start qemu")
-			err = vm.LaunchQemu()
-			if err != nil {
-				panic(err)
-			}
-			defer vm.KillQemu()
-
-			err = vm.SetupNetworkPostLaunch()
-			if err != nil {
-				panic(err)
-			}
-
-			log.Println("start vdocker")
-			err = vm.StartVDocker()
-			if err != nil {
-				log.Errorln(err)
-				panic(err)
-			}
-
-			go func() {
-				sigc := make(chan os.Signal, 1)
-				signal.Notify(sigc,
-					syscall.SIGINT,
-					syscall.SIGTERM,
-					syscall.SIGQUIT)
-
-				sig := <-sigc
-				fmt.Println("TERMINATING")
-				go func() {
-					<-sigc
-					os.Exit(1)
-				}()
-
-				// FIXME send signal via vdocker
-				_ = sig
-
-				time.Sleep(30 * time.Second)
-				vm.Cmd.Process.Kill()
-			}()
-
-			log.Println("vm up")
-			err = vm.Wait()
-			if err == nil {
-				log.Errorf("VM EXIT (code %d) ", vm.Cmd.ProcessState.ExitCode())
-			} else {
-				log.Errorf("VM EXIT (err %s) ", err)
+			code := vm.Run(cmd.Context(), RunOptions{
+				Cradle:         arg_cradle,
+				MetricsAddr:    arg_metrics,
+				ProbeAddr:      arg_probes,
+				TerminationLog: arg_termination,
+			})
+			if code != 0 {
+				os.Exit(code)
 			}
 		},
 	}
@@ -211,5 +140,16 @@ func RunCMD() *cobra.Command {
 
 	runCmd.Flags().Uint16Var(&arg_instance, "instance", 0, "if multiple instances are running, this is a counter to distinguish them")
 
+	runCmd.Flags().DurationVar(&arg_hb_interval, "heartbeat-interval", 5*time.Second, "how often to check that guest init is alive")
+	runCmd.Flags().IntVar(&arg_hb_misses, "heartbeat-misses", 6, "shut the vm down after this many missed heartbeats (0: never)")
+
+	runCmd.Flags().StringVar(&arg_ready, "ready-file", "", "file that exists while the guest is up (default: <workdir>/ready)")
+
+	runCmd.Flags().StringVar(&arg_termination, "termination-log", "/dev/termination-log", "write why the vm stopped here, for the k8s terminationMessagePath")
+
+	runCmd.Flags().StringVar(&arg_probes, "probe-addr", "", "serve /readyz and /livez for k8s http probes on this address (default: disabled)")
+
+	runCmd.Flags().StringVar(&arg_metrics, "metrics-addr", "", "serve prometheus metrics on this address (default: disabled)")
+
 	return runCmd
 }
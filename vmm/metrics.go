@@ -0,0 +1,319 @@
+// Copyright (c) 2020-present devguard GmbH
+
+package vmm
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// prometheus text exposition, written by hand so the vmm does not pull in client_golang
+
+type vmMetrics struct {
+	lock sync.Mutex
+
+	// seconds each boot phase took
+	phases map[string]float64
+
+	layerBytes   int64
+	layerSeconds float64
+	layerCount   int64
+
+	guestUp bool
+}
+
+// as reported by the guest on /v1.41/vmm/stats
+type guestStats struct {
+	Containers []struct {
+		Name     string
+		State    string
+		Restarts int
+		ExitCode int
+		Cgroup   map[string]uint64
+	}
+	Memory map[string]uint64
+}
+
+func (self *VM) recordPhase(phase string, start time.Time) {
+	self.metrics.lock.Lock()
+	defer self.metrics.lock.Unlock()
+
+	if self.metrics.phases == nil {
+		self.metrics.phases = make(map[string]float64)
+	}
+	self.metrics.phases[phase] = time.Since(start).Seconds()
+}
+
+func (self *VM) recordLayer(bytes int64, start time.Time) {
+	self.metrics.lock.Lock()
+	defer self.metrics.lock.Unlock()
+
+	self.metrics.layerBytes += bytes
+	self.metrics.layerSeconds += time.Since(start).Seconds()
+	self.metrics.layerCount += 1
+}
+
+// poll the guest api until it answers, which is as good as "guest up" gets
+func (self *VM) WaitGuestUp(ctx context.Context, start time.Time) {
+
+	for {
+		resp, err := self.guestClient(time.Second).Get("http://cradle/v1.41/vmm/stats")
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode == http.StatusOK {
+				self.recordPhase("guest_up", start)
+				self.metrics.lock.Lock()
+				self.metrics.guestUp = true
+				self.metrics.lock.Unlock()
+				return
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+}
+
+func (self *VM) StartMetrics(addr string) error {
+
+	if addr == "" {
+		return nil
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", self.handleMetrics)
+
+	// listen here, so a taken port fails the phase
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("metrics: %w", err)
+	}
+
+	srv := &http.Server{Handler: mux}
+
+	go func() {
+		err := srv.Serve(l)
+		if err != nil {
+			log.Warn("metrics: ", err)
+		}
+	}()
+
+	return nil
+}
+
+func (self *VM) handleMetrics(w http.ResponseWriter, r *http.Request) {
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	self.metrics.lock.Lock()
+
+	fmt.Fprintln(w, "# HELP cradle_boot_phase_seconds time spent in each boot phase")
+	fmt.Fprintln(w, "# TYPE cradle_boot_phase_seconds gauge")
+	var phases []string
+	for phase := range self.metrics.phases {
+		phases = append(phases, phase)
+	}
+	sort.Strings(phases)
+	for _, phase := range phases {
+		fmt.Fprintf(w, "cradle_boot_phase_seconds{phase=%q} %g\n", phase, self.metrics.phases[phase])
+	}
+
+	fmt.Fprintln(w, "# HELP cradle_layer_download_bytes_total bytes of image layers downloaded")
+	fmt.Fprintln(w, "# TYPE cradle_layer_download_bytes_total counter")
+	fmt.Fprintf(w, "cradle_layer_download_bytes_total %d\n", self.metrics.layerBytes)
+
+	fmt.Fprintln(w, "# HELP cradle_layer_download_seconds_total time spent downloading image layers")
+	fmt.Fprintln(w, "# TYPE cradle_layer_download_seconds_total counter")
+	fmt.Fprintf(w, "cradle_layer_download_seconds_total %g\n", self.metrics.layerSeconds)
+
+	fmt.Fprintln(w, "# HELP cradle_layers_downloaded_total number of image layers downloaded")
+	fmt.Fprintln(w, "# TYPE cradle_layers_downloaded_total counter")
+	fmt.Fprintf(w, "cradle_layers_downloaded_total %d\n", self.metrics.layerCount)
+
+	guestUp := self.metrics.guestUp
+
+	self.metrics.lock.Unlock()
+
+	if self.Cmd != nil && self.Cmd.Process != nil {
+		cpu, rss, err := procUsage(self.Cmd.Process.Pid)
+		if err == nil {
+			fmt.Fprintln(w, "# HELP cradle_qemu_cpu_seconds_total cpu time used by the qemu process")
+			fmt.Fprintln(w, "# TYPE cradle_qemu_cpu_seconds_total counter")
+			fmt.Fprintf(w, "cradle_qemu_cpu_seconds_total %g\n", cpu)
+
+			fmt.Fprintln(w, "# HELP cradle_qemu_resident_memory_bytes resident memory of the qemu process")
+			fmt.Fprintln(w, "# TYPE cradle_qemu_resident_memory_bytes gauge")
+			fmt.Fprintf(w, "cradle_qemu_resident_memory_bytes %d\n", rss)
+		}
+	}
+
+	var stats *guestStats
+	if guestUp {
+		var err error
+		stats, err = self.fetchGuestStats(r.Context())
+		if err != nil {
+			log.Debugf("metrics: %v", err)
+		}
+	}
+
+	fmt.Fprintln(w, "# HELP cradle_guest_up whether the guest api answered this scrape")
+	fmt.Fprintln(w, "# TYPE cradle_guest_up gauge")
+	if stats != nil {
+		fmt.Fprintln(w, "cradle_guest_up 1")
+	} else {
+		fmt.Fprintln(w, "cradle_guest_up 0")
+		return
+	}
+
+	writeGuestStats(w, stats)
+}
+
+func (self *VM) fetchGuestStats(ctx context.Context) (*guestStats, error) {
+
+	req, err := http.NewRequestWithContext(ctx, "GET", "http://cradle/v1.41/vmm/stats", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := self.guestClient(2 * time.Second).Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("guest stats: %s", resp.Status)
+	}
+
+	var stats guestStats
+	err = json.NewDecoder(resp.Body).Decode(&stats)
+	if err != nil {
+		return nil, err
+	}
+
+	return &stats, nil
+}
+
+var containerStates = []string{"created", "running", "exited"}
+
+// per container cgroup stats, with the metric name and type for each key the guest reports
+var cgroupMetrics = []struct {
+	key  string
+	name string
+	typ  string
+	help string
+	div  float64
+}{
+	{"cpu_usage_usec", "cradle_container_cpu_seconds_total", "counter", "cpu time used by the container", 1e6},
+	{"cpu_throttled_usec", "cradle_container_cpu_throttled_seconds_total", "counter", "time the container was throttled", 1e6},
+	{"memory_current", "cradle_container_memory_bytes", "gauge", "memory used by the container", 1},
+	{"memory_peak", "cradle_container_memory_peak_bytes", "gauge", "peak memory used by the container", 1},
+	{"memory_oom_kill", "cradle_container_oom_kills_total", "counter", "processes in the container killed by the oom killer", 1},
+	{"pids_current", "cradle_container_pids", "gauge", "number of processes in the container", 1},
+}
+
+func writeGuestStats(w io.Writer, stats *guestStats) {
+
+	fmt.Fprintln(w, "# HELP cradle_container_state current state of the container")
+	fmt.Fprintln(w, "# TYPE cradle_container_state gauge")
+	for _, c := range stats.Containers {
+		for _, state := range containerStates {
+			v := 0
+			if c.State == state {
+				v = 1
+			}
+			fmt.Fprintf(w, "cradle_container_state{container=%q,state=%q} %d\n", c.Name, state, v)
+		}
+	}
+
+	fmt.Fprintln(w, "# HELP cradle_container_restarts_total number of times the container was restarted")
+	fmt.Fprintln(w, "# TYPE cradle_container_restarts_total counter")
+	for _, c := range stats.Containers {
+		fmt.Fprintf(w, "cradle_container_restarts_total{container=%q} %d\n", c.Name, c.Restarts)
+	}
+
+	fmt.Fprintln(w, "# HELP cradle_container_last_exit_code exit code of the last run of the container")
+	fmt.Fprintln(w, "# TYPE cradle_container_last_exit_code gauge")
+	for _, c := range stats.Containers {
+		fmt.Fprintf(w, "cradle_container_last_exit_code{container=%q} %d\n", c.Name, c.ExitCode)
+	}
+
+	for _, m := range cgroupMetrics {
+		fmt.Fprintf(w, "# HELP %s %s\n", m.name, m.help)
+		fmt.Fprintf(w, "# TYPE %s %s\n", m.name, m.typ)
+		for _, c := range stats.Containers {
+			v, ok := c.Cgroup[m.key]
+			if !ok {
+				continue
+			}
+			fmt.Fprintf(w, "%s{container=%q} %g\n", m.name, c.Name, float64(v)/m.div)
+		}
+	}
+
+	if len(stats.Memory) > 0 {
+		fmt.Fprintln(w, "# HELP cradle_guest_memory_bytes guest memory as seen by the guest kernel")
+		fmt.Fprintln(w, "# TYPE cradle_guest_memory_bytes gauge")
+		for _, k := range []string{"Total", "Free", "Available", "Cached"} {
+			fmt.Fprintf(w, "cradle_guest_memory_bytes{type=%q} %d\n", strings.ToLower(k), stats.Memory[k])
+		}
+	}
+}
+
+// cpu seconds and resident bytes of a host process
+func procUsage(pid int) (float64, uint64, error) {
+
+	stat, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return 0, 0, err
+	}
+
+	// comm may contain spaces, so start after its closing paren
+	i := strings.LastIndexByte(string(stat), ')')
+	if i < 0 {
+		return 0, 0, fmt.Errorf("malformed /proc/%d/stat", pid)
+	}
+	fields := strings.Fields(string(stat[i+1:]))
+	if len(fields) < 13 {
+		return 0, 0, fmt.Errorf("malformed /proc/%d/stat", pid)
+	}
+
+	// utime and stime are fields 14 and 15, in USER_HZ which is 100 on every arch we run on
+	utime, _ := strconv.ParseUint(fields[11], 10, 64)
+	stime, _ := strconv.ParseUint(fields[12], 10, 64)
+	cpu := float64(utime+stime) / 100
+
+	f, err := os.Open(fmt.Sprintf("/proc/%d/status", pid))
+	if err != nil {
+		return 0, 0, err
+	}
+	defer f.Close()
+
+	var rss uint64
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if !strings.HasPrefix(scanner.Text(), "VmRSS:") {
+			continue
+		}
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 2 {
+			kb, _ := strconv.ParseUint(fields[1], 10, 64)
+			rss = kb * 1024
+		}
+	}
+
+	return cpu, rss, nil
+}
@@ -20,6 +20,7 @@ type PodNetwork struct {
 	GuestMac    net.HardwareAddr
 	GuestIfname string
 	CID         uint32
+	PodIP       net.IP
 }
 
 func (self *VM) StartNetwork() error {
@@ -74,6 +75,7 @@ func (self *VM) StartNetwork() error {
 		GuestIfname: "cradle",
 		GuestMac:    net.HardwareAddr{0x00, 0x52, 0x13, 0x12, 0x00, 0x02},
 		CID:         cid,
+		PodIP:       addrs4[0].IP,
 	}
 
 	return nil
@@ -0,0 +1,185 @@
+// Copyright (c) 2020-present devguard GmbH
+
+package vmm
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// ready once guest init is up and all long running containers are running and healthy
+func (self *VM) probeReady() error {
+
+	if !self.hasLaunched() {
+		return fmt.Errorf("vm not launched yet")
+	}
+
+	resp, err := self.guestClient(2 * time.Second).Get("http://cradle/v1.41/vmm/ready")
+	if err != nil {
+		return fmt.Errorf("guest not responding: %w", err)
+	}
+	defer resp.Body.Close()
+
+	var ready struct {
+		Ready  bool
+		Reason string
+	}
+	err = json.NewDecoder(resp.Body).Decode(&ready)
+	if err != nil {
+		return fmt.Errorf("guest ready: %s", resp.Status)
+	}
+
+	if !ready.Ready {
+		return fmt.Errorf("%s", ready.Reason)
+	}
+
+	return nil
+}
+
+// live while qemu runs and the guest answers on vsock.
+// a vm that has not launched or a guest that has not come up yet is still starting,
+// which is up to the startup probe
+func (self *VM) probeLive() error {
+
+	if !self.hasLaunched() {
+		return nil
+	}
+
+	select {
+	case <-self.exited:
+		return fmt.Errorf("vm exited")
+	default:
+	}
+
+	self.metrics.lock.Lock()
+	guestUp := self.metrics.guestUp
+	self.metrics.lock.Unlock()
+
+	if !guestUp {
+		return nil
+	}
+
+	resp, err := self.guestClient(2 * time.Second).Get("http://cradle/v1.41/vmm/ready")
+	if err != nil {
+		return fmt.Errorf("guest not responding: %w", err)
+	}
+	resp.Body.Close()
+
+	return nil
+}
+
+// the guest can only be asked once qemu runs, before that there is no vsock cid
+func (self *VM) hasLaunched() bool {
+	select {
+	case <-self.launched:
+		return true
+	default:
+		return false
+	}
+}
+
+func (self *VM) probeHandler(probe func() error) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		err := probe()
+		if err != nil {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprintln(w, err.Error())
+			return
+		}
+
+		fmt.Fprintln(w, "ok")
+	}
+}
+
+// serve /readyz and /livez for k8s http probes.
+// until ServeProbes the vm is starting: alive, but not ready
+func (self *VM) StartProbes(addr string) error {
+
+	if addr == "" {
+		return nil
+	}
+
+	starting := http.NewServeMux()
+	starting.HandleFunc("/readyz", self.probeHandler(func() error { return fmt.Errorf("starting") }))
+	starting.HandleFunc("/livez", self.probeHandler(func() error { return nil }))
+	self.probes.Store(starting)
+
+	// listen here, so a taken port fails the phase
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("probes: %w", err)
+	}
+
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		self.probes.Load().ServeHTTP(w, r)
+	})}
+
+	go func() {
+		err := srv.Serve(l)
+		if err != nil {
+			log.Warn("probes: ", err)
+		}
+	}()
+
+	return nil
+}
+
+// answer probes from the guest. qemu must run, the guest is reached by its vsock cid
+func (self *VM) ServeProbes() {
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/readyz", self.probeHandler(self.probeReady))
+	mux.HandleFunc("/livez", self.probeHandler(self.probeLive))
+	self.probes.Store(mux)
+}
+
+func ProbeCMD() *cobra.Command {
+
+	var arg_socket string
+
+	probeCmd := &cobra.Command{
+		Use:       "probe <ready|live>",
+		Short:     "check the running vm, for use as k8s exec probe",
+		Args:      cobra.ExactValidArgs(1),
+		ValidArgs: []string{"ready", "live"},
+		Run: func(cmd *cobra.Command, args []string) {
+
+			socket, err := findControlSocket(arg_socket)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+
+			client := controlClient(socket)
+			client.Timeout = 5 * time.Second
+
+			resp, err := client.Get("http://vmm/probe/" + args[0])
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+			defer resp.Body.Close()
+
+			body, _ := io.ReadAll(resp.Body)
+			if resp.StatusCode != http.StatusOK {
+				fmt.Fprintf(os.Stderr, "not %s: %s\n", args[0], strings.TrimSpace(string(body)))
+				os.Exit(1)
+			}
+
+			fmt.Println(args[0])
+		},
+	}
+
+	probeCmd.Flags().StringVar(&arg_socket, "socket", "", "vmm control socket (default: find it)")
+
+	return probeCmd
+}
@@ -3,27 +3,39 @@
 package vmm
 
 import (
-	"crypto/sha256"
 	"encoding/base64"
-	"encoding/json"
 	"fmt"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"syscall"
+	"time"
+
+	"github.com/kraudcloud/cradle/spec"
 )
 
-func (self *VM) qemuArgs() []string {
+func (self *VM) qemuArgs() ([]string, error) {
 
 	if self.CradleGuest.Firmware.PFlash0 != "" {
-		system("cp", self.CradleGuest.Firmware.PFlash0, filepath.Join(self.WorkDir, "files", "pflash0"))
+		err := system("cp", self.CradleGuest.Firmware.PFlash0, filepath.Join(self.WorkDir, "files", "pflash0"))
+		if err != nil {
+			return nil, fmt.Errorf("copy pflash0: %w", err)
+		}
 		self.CradleGuest.Firmware.PFlash0 = filepath.Join(self.WorkDir, "files", "pflash0")
 	}
 	if self.CradleGuest.Firmware.PFlash1 != "" {
-		system("cp", self.CradleGuest.Firmware.PFlash1, filepath.Join(self.WorkDir, "files", "pflash1"))
+		err := system("cp", self.CradleGuest.Firmware.PFlash1, filepath.Join(self.WorkDir, "files", "pflash1"))
+		if err != nil {
+			return nil, fmt.Errorf("copy pflash1: %w", err)
+		}
 		self.CradleGuest.Firmware.PFlash1 = filepath.Join(self.WorkDir, "files", "pflash1")
 	}
 
+	err := self.checkVirtioSlots()
+	if err != nil {
+		return nil, err
+	}
+
 	var bus = "device"
 	var qemuargs []string
 
@@ -35,34 +47,37 @@ func (self *VM) qemuArgs() []string {
 		qemuargs = []string{"qemu-system-x86_64"}
 		qemuargs = self.qemuArgsSnp(qemuargs)
 	} else {
-		panic(fmt.Errorf("Unsupported machine type: %s", self.CradleGuest.Machine.Type))
+		return nil, fmt.Errorf("unsupported machine type: %s", self.CradleGuest.Machine.Type)
 	}
 
 	// cpu, mem
 
-	var smp = self.Launch.Resources.Cpu
-	if smp < 1 {
-		smp = 1
-	}
-
-	if self.Launch.Resources.Mem < 1024 {
-		self.Launch.Resources.Mem = 1024
-	}
-	mem := self.Launch.Resources.Mem
-
-	qemuargs = append(qemuargs, "-smp", fmt.Sprintf("%d,maxcpus=32", smp), "-m", fmt.Sprintf("%dM,slots=5,maxmem=128G", mem))
+	qemuargs = append(qemuargs, "-smp", fmt.Sprintf("%d,maxcpus=32", self.guestCpus()), "-m", fmt.Sprintf("%dM,slots=5,maxmem=128G", self.guestMemory()))
 
 	if self.CradleGuest.Machine.Type != "snp" {
 
 		// TODO this is for virtiofsd, but i don't fully understand its implications on security
 		qemuargs = append(qemuargs,
 			"-object",
-			fmt.Sprintf("memory-backend-file,id=mem,size=%dM,mem-path=/dev/shm,share=on", mem),
+			fmt.Sprintf("memory-backend-file,id=mem,size=%dM,mem-path=/dev/shm,share=on", self.guestMemory()),
 			"-numa", "node,memdev=mem",
 		)
 
 	}
 
+	// management
+	qemuargs = append(qemuargs,
+		"-qmp", fmt.Sprintf("unix:%s,server=on,wait=off", self.qmpSocketPath()),
+	)
+
+	// return memory freed by the guest to the host.
+	// virtio devices from here on are counted in virtioDevices
+	if self.hasBalloon() {
+		qemuargs = append(qemuargs,
+			"-device", "virtio-balloon-"+bus+",id=balloon0,free-page-reporting=on,deflate-on-oom=on",
+		)
+	}
+
 	// vdocker
 	qemuargs = append(qemuargs,
 		"-device", fmt.Sprintf("vhost-vsock-"+bus+",guest-cid=%d", self.PodNetwork.CID),
@@ -126,6 +141,22 @@ func (self *VM) qemuArgs() []string {
 
 	}
 
+	// file volumes, tagged by their index so the guest can find them
+	for i, volume := range self.Launch.Volumes {
+
+		if volume.Transport == "virtiofs" {
+			qemuargs = append(qemuargs,
+				"-chardev", fmt.Sprintf("socket,id=char-fs%d,path=%s", i, self.fsSocketPath(i)),
+				"-device", fmt.Sprintf("vhost-user-fs-"+bus+",chardev=char-fs%d,tag=fs%d,queue-size=1024", i, i),
+			)
+		} else if volume.Transport == "9p" {
+			qemuargs = append(qemuargs,
+				"-fsdev", fmt.Sprintf("local,id=fs%d,path=%s,security_model=passthrough", i, volume.HostPath),
+				"-device", fmt.Sprintf("virtio-9p-"+bus+",fsdev=fs%d,mount_tag=fs%d", i, i),
+			)
+		}
+	}
+
 	// layers
 	for i := 0; i < self.layerCount; i++ {
 
@@ -140,13 +171,24 @@ func (self *VM) qemuArgs() []string {
 		)
 	}
 
-	// watchdog
-	// FIXME requires pci?
-	// qemuargs = append(qemuargs, "-watchdog", "i6300esb", "-watchdog-action", "reset")
+	// watchdog, petted by guest init. microvm has no pci, but it does have an isa bus.
+	// with -no-reboot the reset ends qemu, and the WATCHDOG event tells us why
+	if bus == "pci" {
+		qemuargs = append(qemuargs, "-device", "i6300esb")
+	} else {
+		qemuargs = append(qemuargs, "-device", "ib700")
+	}
+	qemuargs = append(qemuargs, "-action", "watchdog=reset")
+
+	// pvpanic turns a guest panic into a GUEST_PANICKED event.
+	// without it we go by the serial console
+	if self.hasPvpanic() {
+		qemuargs = append(qemuargs, "-device", "pvpanic-pci")
+	}
 
-	log.Println(qemuargs)
+	log.Println(self.redact(fmt.Sprint(qemuargs)))
 
-	return qemuargs
+	return qemuargs, nil
 }
 
 func (self *VM) qemuArgsMicroVm(qemuargs []string) []string {
@@ -162,7 +204,7 @@ func (self *VM) qemuArgsMicroVm(qemuargs []string) []string {
 		"-M", "microvm,x-option-roms=off,pit=off,pic=off,isa-serial=on,rtc=off", // ,ioapic2=on would have 24 virtio instead of 8
 		"-serial", "mon:stdio",
 		"-kernel", self.CradleGuest.Kernel.Kernel,
-		"-append", "earlyprintk=ttyS0 console=ttyS0 panic=2",
+		"-append", self.kernelCmdline(),
 	)
 
 	// FIXME
@@ -178,16 +220,9 @@ func (self *VM) qemuArgsMicroVm(qemuargs []string) []string {
 
 func (self *VM) qemuArgsSnp(qemuargs []string) []string {
 
-	if self.Launch.Resources.Mem < 1024 {
-		self.Launch.Resources.Mem = 1024
-	}
-	mem := self.Launch.Resources.Mem
+	mem := self.guestMemory()
 
-	launchHash := sha256.New()
-	json.NewEncoder(launchHash).Encode(map[string]interface{}{
-		"ID": self.Launch.ID,
-	})
-	host_data_b64 := base64.StdEncoding.EncodeToString(launchHash.Sum(nil))
+	host_data_b64 := base64.StdEncoding.EncodeToString(spec.HostData(self.Launch.ID, self.Launch.KeyBrokers()))
 
 	qemuargs = append(qemuargs,
 		"-vga", "none",
@@ -206,7 +241,7 @@ func (self *VM) qemuArgsSnp(qemuargs []string) []string {
 		"-object", "sev-snp-guest,id=sev0,cbitpos=51,reduced-phys-bits=1,host-data="+host_data_b64,
 
 		"-kernel", self.CradleGuest.Kernel.Kernel,
-		"-append", "earlyprintk=ttyS0 console=ttyS0 panic=2",
+		"-append", self.kernelCmdline(),
 	)
 
 	if self.CradleGuest.Kernel.Initrd != "" {
@@ -243,11 +278,18 @@ func (self *VM) LaunchQemu() (err error) {
 		return err
 	}
 
-	qemuargs := self.qemuArgs()
+	qemuargs, err := self.qemuArgs()
+	if err != nil {
+		return err
+	}
 
 	self.Cmd = exec.Command(qemuargs[0], qemuargs[1:]...)
 	self.Cmd.Stderr = os.Stdout
-	self.Cmd.Stdout = os.Stderr
+	// the console goes to our stderr line by line, with secrets redacted
+	self.Cmd.Stdout = &self.serial
+	self.serial.out = os.Stderr
+	self.serial.redact = self.redact
+	self.serial.onLine = self.scanSerial
 
 	self.Cmd.SysProcAttr = &syscall.SysProcAttr{
 		Setpgid:    true,
@@ -260,13 +302,83 @@ func (self *VM) LaunchQemu() (err error) {
 		return err
 	}
 
+	close(self.launched)
+
 	return nil
 }
 
 func (self *VM) KillQemu() {
-	self.Cmd.Process.Kill()
+	if self.QMP != nil {
+		self.QMP.Close()
+	}
+	if self.Cmd != nil && self.Cmd.Process != nil {
+		self.Cmd.Process.Kill()
+	}
+}
+
+// wait for qemu to exit and tell why it did
+func (self *VM) Wait() (ExitReason, error) {
+
+	err := self.Cmd.Wait()
+	close(self.exited)
+
+	// the guest shutdown event may still be on its way
+	select {
+	case <-self.eventsDone:
+	case <-time.After(3 * time.Second):
+		log.Warn("guest event stream did not end after vm exit")
+	}
+
+	reason, detail := self.exit.get()
+
+	// qemu exits cleanly after any SHUTDOWN event, anything else means it died
+	if err != nil && reason == ExitUnknown {
+		reason = ExitQemuCrash
+	}
+
+	if detail != "" {
+		log.Printf("vm exit reason: %s (%s)", reason, detail)
+	} else {
+		log.Printf("vm exit reason: %s", reason)
+	}
+
+	return reason, err
 }
 
-func (self *VM) Wait() error {
-	return self.Cmd.Wait()
+// graceful shutdown. the guest gets timeout to stop its containers before qemu is terminated
+func (self *VM) Shutdown(reason string, timeout time.Duration) {
+
+	self.exit.set(ExitHostShutdown, reason)
+
+	err := self.guestShutdown(reason)
+	if err != nil {
+		log.Warnf("shutdown via vdocker: %v", err)
+	}
+
+	if self.QMP != nil {
+		err = self.QMP.Powerdown()
+		if err != nil {
+			log.Warnf("shutdown via qmp: %v", err)
+		}
+	}
+
+	select {
+	case <-self.exited:
+		return
+	case <-time.After(timeout):
+	}
+
+	log.Warnf("guest did not power off within %s, terminating qemu", timeout)
+
+	if self.QMP != nil {
+		self.QMP.Quit()
+
+		select {
+		case <-self.exited:
+			return
+		case <-time.After(5 * time.Second):
+		}
+	}
+
+	self.Cmd.Process.Kill()
 }
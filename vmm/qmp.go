@@ -0,0 +1,354 @@
+// Copyright (c) 2020-present devguard GmbH
+
+package vmm
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// qemu machine protocol client
+// https://www.qemu.org/docs/master/interop/qemu-qmp-ref.html
+type QMP struct {
+	conn net.Conn
+
+	// commands waiting for their return, by id
+	lock    sync.Mutex
+	serial  uint64
+	pending map[uint64]chan qmpMessage
+
+	subscribersLock sync.Mutex
+	subscribers     []chan QMPEvent
+
+	closed chan struct{}
+}
+
+type QMPEvent struct {
+	Event     string          `json:"event"`
+	Data      json.RawMessage `json:"data,omitempty"`
+	Timestamp time.Time       `json:"-"`
+}
+
+type qmpMessage struct {
+	ID        uint64          `json:"id,omitempty"`
+	Return    json.RawMessage `json:"return,omitempty"`
+	Error     *qmpError       `json:"error,omitempty"`
+	Event     string          `json:"event,omitempty"`
+	Data      json.RawMessage `json:"data,omitempty"`
+	Timestamp struct {
+		Seconds      int64 `json:"seconds"`
+		Microseconds int64 `json:"microseconds"`
+	} `json:"timestamp,omitempty"`
+}
+
+type qmpError struct {
+	Class string `json:"class"`
+	Desc  string `json:"desc"`
+}
+
+func (e *qmpError) Error() string {
+	return fmt.Sprintf("qmp: %s: %s", e.Class, e.Desc)
+}
+
+func (self *VM) qmpSocketPath() string {
+	return filepath.Join(self.WorkDir, "mgm", "qmp.sock")
+}
+
+// connect to the qmp socket of a launched qemu
+func (self *VM) ConnectQMP() error {
+
+	var conn net.Conn
+	var err error
+
+	// qemu creates the socket shortly after start
+	for i := 0; i < 100; i++ {
+		conn, err = net.Dial("unix", self.qmpSocketPath())
+		if err == nil {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if err != nil {
+		return fmt.Errorf("qmp: dial %s: %w", self.qmpSocketPath(), err)
+	}
+
+	self.QMP = &QMP{
+		conn:    conn,
+		pending: make(map[uint64]chan qmpMessage),
+		closed:  make(chan struct{}),
+	}
+
+	scanner := bufio.NewScanner(conn)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+
+	// greeting
+	if !scanner.Scan() {
+		conn.Close()
+		return fmt.Errorf("qmp: no greeting: %v", scanner.Err())
+	}
+
+	go self.QMP.read(scanner)
+
+	err = self.QMP.Execute("qmp_capabilities", nil, nil)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+
+	go self.watchQMPEvents(self.QMP.Subscribe())
+
+	return nil
+}
+
+func (self *QMP) read(scanner *bufio.Scanner) {
+
+	defer func() {
+		self.subscribersLock.Lock()
+		for _, ch := range self.subscribers {
+			close(ch)
+		}
+		self.subscribers = nil
+
+		// under the lock, so Subscribe can't add to a closed qmp
+		close(self.closed)
+		self.subscribersLock.Unlock()
+	}()
+
+	for scanner.Scan() {
+
+		var msg qmpMessage
+		err := json.Unmarshal(scanner.Bytes(), &msg)
+		if err != nil {
+			log.Warnf("qmp: %v", err)
+			continue
+		}
+
+		if msg.Event != "" {
+			log.Printf("qmp: event %s %s", msg.Event, string(msg.Data))
+
+			ev := QMPEvent{
+				Event:     msg.Event,
+				Data:      msg.Data,
+				Timestamp: time.Unix(msg.Timestamp.Seconds, msg.Timestamp.Microseconds*1000),
+			}
+
+			self.subscribersLock.Lock()
+			for _, ch := range self.subscribers {
+				select {
+				case ch <- ev:
+				default:
+					log.Warnf("qmp: subscriber too slow, dropping event %s", ev.Event)
+				}
+			}
+			self.subscribersLock.Unlock()
+
+			continue
+		}
+
+		// the command may have timed out already
+		self.lock.Lock()
+		if ch, ok := self.pending[msg.ID]; ok {
+			ch <- msg
+			delete(self.pending, msg.ID)
+		}
+		self.lock.Unlock()
+	}
+}
+
+// receive all qmp events from now on. the channel is closed when qemu goes away.
+// events are dropped if the subscriber does not keep up
+func (self *QMP) Subscribe() <-chan QMPEvent {
+
+	ch := make(chan QMPEvent, 64)
+
+	self.subscribersLock.Lock()
+	defer self.subscribersLock.Unlock()
+
+	select {
+	case <-self.closed:
+		close(ch)
+	default:
+		self.subscribers = append(self.subscribers, ch)
+	}
+
+	return ch
+}
+
+func (self *QMP) Unsubscribe(ch <-chan QMPEvent) {
+
+	self.subscribersLock.Lock()
+	defer self.subscribersLock.Unlock()
+
+	for i, c := range self.subscribers {
+		if c == ch {
+			self.subscribers = append(self.subscribers[:i], self.subscribers[i+1:]...)
+			close(c)
+			return
+		}
+	}
+}
+
+// how long a command may take. none of the ones we use wait for the guest
+const qmpTimeout = 30 * time.Second
+
+// execute a qmp command and decode its return value into result, which may be nil
+func (self *QMP) Execute(command string, arguments interface{}, result interface{}) error {
+
+	ch := make(chan qmpMessage, 1)
+
+	self.lock.Lock()
+	self.serial += 1
+	id := self.serial
+	self.pending[id] = ch
+	self.lock.Unlock()
+
+	defer func() {
+		self.lock.Lock()
+		delete(self.pending, id)
+		self.lock.Unlock()
+	}()
+
+	cmd := map[string]interface{}{
+		"execute": command,
+		"id":      id,
+	}
+	if arguments != nil {
+		cmd["arguments"] = arguments
+	}
+
+	js, err := json.Marshal(cmd)
+	if err != nil {
+		return err
+	}
+
+	_, err = self.conn.Write(append(js, '\n'))
+	if err != nil {
+		return fmt.Errorf("qmp: %s: %w", command, err)
+	}
+
+	var msg qmpMessage
+	select {
+	case msg = <-ch:
+	case <-self.closed:
+		return fmt.Errorf("qmp: %s: connection closed", command)
+	case <-time.After(qmpTimeout):
+		return fmt.Errorf("qmp: %s: no answer within %s", command, qmpTimeout)
+	}
+
+	if msg.Error != nil {
+		return msg.Error
+	}
+
+	if result != nil && msg.Return != nil {
+		return json.Unmarshal(msg.Return, result)
+	}
+
+	return nil
+}
+
+// run state of the vm, like "running", "paused", "shutdown", "guest-panicked", "watchdog"
+func (self *QMP) QueryStatus() (string, error) {
+
+	var status struct {
+		Status  string `json:"status"`
+		Running bool   `json:"running"`
+	}
+
+	err := self.Execute("query-status", nil, &status)
+	if err != nil {
+		return "", err
+	}
+
+	return status.Status, nil
+}
+
+// acpi power button. only works with acpi guests
+func (self *QMP) Powerdown() error {
+	return self.Execute("system_powerdown", nil, nil)
+}
+
+// terminate qemu immediately
+func (self *QMP) Quit() error {
+	return self.Execute("quit", nil, nil)
+}
+
+func (self *QMP) DeviceAdd(args map[string]interface{}) error {
+	return self.Execute("device_add", args, nil)
+}
+
+// request removal of a device. the guest has to acknowledge,
+// which is signaled with a DEVICE_DELETED event
+func (self *QMP) DeviceDel(id string) error {
+	return self.Execute("device_del", map[string]interface{}{
+		"id": id,
+	}, nil)
+}
+
+// add a raw image or block device as block backend with the node name id
+func (self *QMP) BlockdevAdd(id string, filename string, readonly bool) error {
+
+	driver := "file"
+	if isBlockDevice(filename) {
+		driver = "host_device"
+	}
+
+	return self.Execute("blockdev-add", map[string]interface{}{
+		"driver":    "raw",
+		"node-name": id,
+		"read-only": readonly,
+		"file": map[string]interface{}{
+			"driver":   driver,
+			"filename": filename,
+		},
+	}, nil)
+}
+
+func (self *QMP) BlockdevDel(id string) error {
+	return self.Execute("blockdev-del", map[string]interface{}{
+		"node-name": id,
+	}, nil)
+}
+
+// wait for DEVICE_DELETED of a device previously removed with DeviceDel
+func (self *QMP) WaitDeviceDeleted(events <-chan QMPEvent, id string, timeout time.Duration) error {
+
+	deadline := time.After(timeout)
+	for {
+		select {
+		case ev, ok := <-events:
+			if !ok {
+				return fmt.Errorf("qmp: connection closed")
+			}
+			if ev.Event != "DEVICE_DELETED" {
+				continue
+			}
+			var data struct {
+				Device string `json:"device"`
+			}
+			json.Unmarshal(ev.Data, &data)
+			if data.Device == id {
+				return nil
+			}
+		case <-deadline:
+			return fmt.Errorf("qmp: guest did not release device %s within %s", id, timeout)
+		}
+	}
+}
+
+func isBlockDevice(path string) bool {
+	stat, err := os.Stat(path)
+	if err != nil {
+		return false
+	}
+	return stat.Mode()&os.ModeDevice != 0
+}
+
+func (self *QMP) Close() error {
+	return self.conn.Close()
+}
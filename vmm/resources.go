@@ -0,0 +1,191 @@
+// Copyright (c) 2020-present devguard GmbH
+
+package vmm
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/kraudcloud/cradle/spec"
+)
+
+// memory the pod needs on top of guest ram, for qemu itself and the vmm
+const vmmOverheadMB = 256
+
+// memory limit of the cgroup the vmm runs in, which is the k8s container limit.
+// returns 0 if there is no limit
+func cgroupMemoryLimit() (int, error) {
+
+	b, err := os.ReadFile("/sys/fs/cgroup/memory.max")
+	if err != nil {
+		return 0, err
+	}
+
+	s := strings.TrimSpace(string(b))
+	if s == "max" {
+		return 0, nil
+	}
+
+	v, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("memory.max: %w", err)
+	}
+
+	return int(v / 1024 / 1024), nil
+}
+
+// cpu limit of the cgroup the vmm runs in, rounded up to whole cpus.
+// returns 0 if there is no limit
+func cgroupCpuLimit() (int, error) {
+
+	b, err := os.ReadFile("/sys/fs/cgroup/cpu.max")
+	if err != nil {
+		return 0, err
+	}
+
+	quota, period, _ := strings.Cut(strings.TrimSpace(string(b)), " ")
+	if quota == "max" {
+		return 0, nil
+	}
+
+	q, err := strconv.ParseInt(quota, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("cpu.max: %w", err)
+	}
+	p, err := strconv.ParseInt(period, 10, 64)
+	if err != nil || p == 0 {
+		return 0, fmt.Errorf("cpu.max: invalid period '%s'", period)
+	}
+
+	return int((q + p - 1) / p), nil
+}
+
+// vcpus the vm boots with, as in -smp
+func (self *VM) guestCpus() int {
+	if self.Launch.Resources.Cpu < 1 {
+		return 1
+	}
+	return self.Launch.Resources.Cpu
+}
+
+// guest ram in MiB, as in -m
+func (self *VM) guestMemory() int {
+	if self.Launch.Resources.Mem < 1024 {
+		return 1024
+	}
+	return self.Launch.Resources.Mem
+}
+
+// change what the pod may use at runtime. zero leaves the respective resource alone.
+// neither machine type can hotplug cpus or memory: microvm runs without acpi and sev-snp
+// doesn't support it. so the vm keeps its boot size, the balloon and the container cgroups
+// enforce less, and growing past the boot size needs a restart
+func (self *VM) Resize(cpu int, mem int) error {
+
+	self.resizeLock.Lock()
+	defer self.resizeLock.Unlock()
+
+	var errs []string
+
+	if cpu > 0 {
+		log.Printf("resize: %d cpus", cpu)
+		if cpu > self.guestCpus() {
+			errs = append(errs, fmt.Sprintf("vm booted with %d cpus, growing to %d needs a restart", self.guestCpus(), cpu))
+		}
+	}
+
+	if mem > 0 {
+		log.Printf("resize: %dM memory", mem)
+		if mem > self.guestMemory() {
+			errs = append(errs, fmt.Sprintf("vm booted with %dM memory, growing to %dM needs a restart", self.guestMemory(), mem))
+		}
+
+		if self.hasBalloon() {
+			err := self.SetBalloon(mem)
+			if err != nil {
+				errs = append(errs, err.Error())
+			}
+		}
+	}
+
+	err := self.guestResources(spec.Resources{Cpu: cpu, Mem: mem})
+	if err != nil {
+		errs = append(errs, err.Error())
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("resize: %s", strings.Join(errs, ", "))
+	}
+
+	return nil
+}
+
+// follow k8s in-place pod resize by watching our own cgroup limits
+func (self *VM) WatchResources(ctx context.Context) {
+
+	if self.hasBalloon() {
+		// report guest stats to the balloon driver, so qom-get guest-stats works
+		err := self.QMP.Execute("qom-set", map[string]interface{}{
+			"path":     "/machine/peripheral/balloon0",
+			"property": "guest-stats-polling-interval",
+			"value":    10,
+		}, nil)
+		if err != nil {
+			log.Warnf("balloon: enable guest stats: %v", err)
+		}
+	}
+
+	// the limits at launch are what the vm was sized for
+	lastCpu, _ := cgroupCpuLimit()
+	lastMem, _ := cgroupMemoryLimit()
+
+	for {
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(10 * time.Second):
+		}
+
+		cpuLimit, err := cgroupCpuLimit()
+		if err != nil {
+			log.Warnf("resize: %v", err)
+			return
+		}
+
+		memLimit, err := cgroupMemoryLimit()
+		if err != nil {
+			log.Warnf("resize: %v", err)
+			return
+		}
+
+		if cpuLimit == lastCpu && memLimit == lastMem {
+			continue
+		}
+
+		log.Printf("resize: pod limits changed to cpu %d mem %dM", cpuLimit, memLimit)
+
+		var cpu, mem int
+		if cpuLimit != lastCpu && cpuLimit > 0 {
+			cpu = cpuLimit
+		}
+		if memLimit != lastMem && memLimit > 0 {
+			mem = memLimit - vmmOverheadMB
+			if mem < 512 {
+				mem = 512
+			}
+		}
+
+		lastCpu = cpuLimit
+		lastMem = memLimit
+
+		err = self.Resize(cpu, mem)
+		if err != nil {
+			log.Error(err)
+		}
+	}
+}
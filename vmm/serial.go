@@ -0,0 +1,114 @@
+// Copyright (c) 2020-present devguard GmbH
+
+package vmm
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"sync"
+)
+
+// last lines of the guest serial console, so we can say what the guest was doing when it died
+type serialLog struct {
+	lock    sync.Mutex
+	lines   []string
+	partial []byte
+
+	// complete lines are passed on to out, after redact
+	out    io.Writer
+	redact func(string) string
+
+	// called with every complete line, under lock
+	onLine func(string)
+}
+
+const serialLogLines = 200
+
+func (self *serialLog) Write(p []byte) (int, error) {
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	self.partial = append(self.partial, p...)
+
+	for {
+		i := bytes.IndexByte(self.partial, '\n')
+		if i < 0 {
+			break
+		}
+
+		line := self.redact(strings.TrimRight(string(self.partial[:i]), "\r"))
+		self.partial = self.partial[i+1:]
+
+		self.lines = append(self.lines, line)
+		io.WriteString(self.out, line+"\n")
+
+		if self.onLine != nil {
+			self.onLine(line)
+		}
+	}
+
+	// a guest that never sends a newline should not eat our memory
+	if len(self.partial) > 4096 {
+		line := self.redact(string(self.partial))
+		self.lines = append(self.lines, line)
+		io.WriteString(self.out, line+"\n")
+		self.partial = nil
+	}
+
+	if len(self.lines) > serialLogLines {
+		self.lines = self.lines[len(self.lines)-serialLogLines:]
+	}
+
+	return len(p), nil
+}
+
+// up to n of the last lines, including an unterminated one
+func (self *serialLog) Tail(n int) []string {
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	lines := self.lines
+	if len(self.partial) > 0 {
+		lines = append(append([]string(nil), lines...), self.redact(string(self.partial)))
+	}
+	if len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+
+	return append([]string(nil), lines...)
+}
+
+// pvpanic-pci. the isa variant is only discoverable through acpi, which microvm doesn't have
+func (self *VM) hasPvpanic() bool {
+	return self.CradleGuest.Machine.Type != "microvm"
+}
+
+// the kernel tells us on the console when it panics or kills something for memory.
+// only kernel records count: they start with a "[   12.345678] " timestamp,
+// and guest init tags its own, which may carry anything a container said
+func (self *VM) scanSerial(line string) {
+
+	if !strings.HasPrefix(line, "[") {
+		return
+	}
+	i := strings.Index(line, "] ")
+	if i < 0 {
+		return
+	}
+	msg := line[i+2:]
+
+	switch {
+	case strings.HasPrefix(msg, "Kernel panic - not syncing"):
+		// GUEST_PANICKED says the same, without reading the console
+		if !self.hasPvpanic() {
+			self.exit.set(ExitGuestPanic, msg)
+		}
+
+	case strings.HasPrefix(msg, "Out of memory: Killed process"),
+		strings.HasPrefix(msg, "Memory cgroup out of memory: Killed process"):
+		self.exit.oomKill(msg)
+	}
+}
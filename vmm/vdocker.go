@@ -23,7 +23,8 @@ func (self *VM) StartVDocker() error {
 		for {
 			conn, err := dockerSocker.AcceptUnix()
 			if err != nil {
-				panic(err)
+				log.Errorf("vdocker: %v", err)
+				return
 			}
 
 			go func() {
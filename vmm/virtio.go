@@ -0,0 +1,48 @@
+// Copyright (c) 2020-present devguard GmbH
+
+package vmm
+
+import (
+	"fmt"
+	"strings"
+)
+
+// microvm has a fixed number of virtio-mmio transports, one per device.
+// every virtio device qemuArgs adds must be listed in virtioDevices
+const microvmVirtioSlots = 8
+
+// the virtio devices the vm gets at boot, in the order qemuArgs adds them
+func (self *VM) virtioDevices() []string {
+
+	var devices []string
+
+	if self.hasBalloon() {
+		devices = append(devices, "balloon")
+	}
+
+	devices = append(devices, "vsock", "net", "cache disk", "scsi")
+
+	for _, volume := range self.Launch.Volumes {
+		if volume.Transport == "virtiofs" || volume.Transport == "9p" {
+			devices = append(devices, "fs "+volume.Name)
+		}
+	}
+
+	return devices
+}
+
+// fail before qemu does, with a message that says what to drop
+func (self *VM) checkVirtioSlots() error {
+
+	if self.CradleGuest.Machine.Type != "microvm" {
+		return nil
+	}
+
+	devices := self.virtioDevices()
+	if len(devices) > microvmVirtioSlots {
+		return fmt.Errorf("microvm has %d virtio slots, but this launch needs %d: %s",
+			microvmVirtioSlots, len(devices), strings.Join(devices, ", "))
+	}
+
+	return nil
+}
@@ -0,0 +1,134 @@
+// Copyright (c) 2020-present devguard GmbH
+
+package vmm
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/kraudcloud/cradle/spec"
+)
+
+// hotplug a block volume into the running vm.
+// volumes keep their index in Launch.Volumes forever, so device ids are never reused
+func (self *VM) AttachVolume(volume spec.Volume) error {
+
+	self.volumesLock.Lock()
+	defer self.volumesLock.Unlock()
+
+	if volume.Name == "" || volume.DevicePath == "" {
+		return fmt.Errorf("attach volume: name and devicePath required")
+	}
+
+	for _, v := range self.Launch.Volumes {
+		if v.Name == volume.Name && v.DevicePath != "" {
+			return fmt.Errorf("attach volume: %s already attached", volume.Name)
+		}
+	}
+
+	i := len(self.Launch.Volumes)
+	node := fmt.Sprintf("drive-virtio-volume-%d", i)
+	id := fmt.Sprintf("virtio-volume-%d", i)
+
+	err := self.QMP.BlockdevAdd(node, volume.DevicePath, false)
+	if err != nil {
+		return fmt.Errorf("attach volume %s: %w", volume.Name, err)
+	}
+
+	err = self.QMP.DeviceAdd(map[string]interface{}{
+		"driver":    "scsi-hd",
+		"bus":       "scsi0.0",
+		"drive":     node,
+		"id":        id,
+		"serial":    fmt.Sprintf("volume.%d", i),
+		"device_id": fmt.Sprintf("volume.%s.img", volume.Name),
+	})
+	if err != nil {
+		self.QMP.BlockdevDel(node)
+		return fmt.Errorf("attach volume %s: %w", volume.Name, err)
+	}
+
+	// the index is taken either way, the device id can't be reused before qemu released it
+	self.Launch.Volumes = append(self.Launch.Volumes, volume)
+	if self.hotVolumes == nil {
+		self.hotVolumes = make(map[string]bool)
+	}
+	self.hotVolumes[node] = true
+
+	err = self.guestAttachVolume(volume)
+	if err != nil {
+		derr := self.unplugVolume(i)
+		if derr != nil {
+			log.Errorf("attach volume %s: unplug after failed mount: %v", volume.Name, derr)
+		}
+		return err
+	}
+
+	log.Printf("attached volume %s from %s", volume.Name, volume.DevicePath)
+
+	return nil
+}
+
+// unmount a volume in the guest and unplug it
+func (self *VM) DetachVolume(name string) error {
+
+	self.volumesLock.Lock()
+	defer self.volumesLock.Unlock()
+
+	index := -1
+	for i, v := range self.Launch.Volumes {
+		if v.Name == name && v.DevicePath != "" {
+			index = i
+		}
+	}
+	if index == -1 {
+		return fmt.Errorf("detach volume: %s not attached", name)
+	}
+
+	err := self.guestDetachVolume(name)
+	if err != nil {
+		return err
+	}
+
+	err = self.unplugVolume(index)
+	if err != nil {
+		return fmt.Errorf("detach volume %s: %w", name, err)
+	}
+
+	log.Printf("detached volume %s", name)
+
+	return nil
+}
+
+// remove the device of a volume, and its backend if we added it.
+// qemu drops backends of -drive itself when their device goes
+func (self *VM) unplugVolume(index int) error {
+
+	events := self.QMP.Subscribe()
+	defer self.QMP.Unsubscribe(events)
+
+	id := fmt.Sprintf("virtio-volume-%d", index)
+	node := fmt.Sprintf("drive-virtio-volume-%d", index)
+
+	err := self.QMP.DeviceDel(id)
+	if err != nil {
+		return err
+	}
+
+	err = self.QMP.WaitDeviceDeleted(events, id, 30*time.Second)
+	if err != nil {
+		return err
+	}
+
+	if self.hotVolumes[node] {
+		err = self.QMP.BlockdevDel(node)
+		if err != nil {
+			return err
+		}
+		delete(self.hotVolumes, node)
+	}
+
+	self.Launch.Volumes[index].DevicePath = ""
+
+	return nil
+}
@@ -0,0 +1,61 @@
+// Copyright (c) 2020-present devguard GmbH
+
+package vmm
+
+import (
+	"context"
+	"time"
+)
+
+// the guest watchdog resets the vm when guest init hangs, which ends qemu because of -no-reboot.
+// this catches what it can't: a vm that qemu stopped instead of resetting, and qemu itself hanging
+func (self *VM) WatchHang(ctx context.Context) {
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-self.exited:
+			return
+		case <-time.After(5 * time.Second):
+		}
+
+		status := make(chan string, 1)
+		go func() {
+			s, err := self.QMP.QueryStatus()
+			if err != nil {
+				s = ""
+			}
+			status <- s
+		}()
+
+		var s string
+		select {
+		case s = <-status:
+		case <-ctx.Done():
+			return
+		case <-self.exited:
+			return
+		case <-time.After(30 * time.Second):
+			log.Errorf("qemu not responding on qmp for 30s, killing it")
+			self.exit.set(ExitQemuCrash, "qemu not responding")
+			self.Cmd.Process.Kill()
+			return
+		}
+
+		switch s {
+		case "watchdog":
+			self.exit.set(ExitWatchdog, "vm stopped by watchdog")
+		case "guest-panicked":
+			self.exit.set(ExitGuestPanic, "vm stopped after guest panic")
+		case "internal-error":
+			self.exit.set(ExitQemuCrash, "qemu internal error")
+		default:
+			continue
+		}
+
+		log.Errorf("vm is in state %s, terminating qemu", s)
+		self.QMP.Quit()
+		return
+	}
+}